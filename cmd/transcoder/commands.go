@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/filecache"
+	"github.com/anacrolix/tagflag"
+	"github.com/dustin/go-humanize"
+
+	"github.com/anacrolix/webtorrent-public/gateway"
+	"github.com/anacrolix/webtorrent-public/services"
+	"github.com/anacrolix/webtorrent-public/services/transcoder"
+	"github.com/anacrolix/webtorrent-public/services/transcoder/client"
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
+
+func parseCommandArgs(cmd interface{}, name string, args []string) {
+	tagflag.ParseArgs(cmd, args, tagflag.Program("transcoder "+name))
+}
+
+// A short description of the progress, such as "downloading 40%".
+func describeProgress(p transcoder.Progress) string {
+	switch {
+	case p.Ready:
+		return "ready"
+	case p.Queued:
+		return "queued"
+	case p.Storing:
+		if p.StoreProgress.Ok {
+			return fmt.Sprintf("storing %.0f%%", p.StoreProgress.Value*100)
+		}
+		return "storing"
+	case p.Converting:
+		s := "converting " + p.ConvertPos.Round(time.Second).String()
+		if p.OutputDuration != 0 {
+			s += "/" + p.OutputDuration.Round(time.Second).String()
+		}
+		if p.Pieces != 0 {
+			s += fmt.Sprintf(", %d/%d pieces", p.PiecesComplete, p.Pieces)
+		}
+		return s
+	case p.Downloading:
+		// Torrent inputs keep downloading while they're converted, so this comes after Converting.
+		return fmt.Sprintf("downloading %.0f%%", p.DownloadProgress*100)
+	case p.Analyzing:
+		return "analyzing loudness " + p.AnalyzePos.Round(time.Second).String()
+	case p.Probing:
+		return "probing"
+	}
+	return "starting"
+}
+
+// Runs the job in this process, as the server would for the same request, printing progress to
+// stderr. The output is copied to out if it's set.
+func runLocally(ctx context.Context, c config, r client.Request, out string) error {
+	if err := c.findTools(); err != nil {
+		return err
+	}
+	t, cleanup, err := newTranscoder(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	t.Init()
+	var last string
+	name, err := t.Run(ctx, r.Query(), func(p transcoder.Progress) {
+		if s := describeProgress(p); s != last {
+			fmt.Fprintln(os.Stderr, s)
+			last = s
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if out == "" {
+		fmt.Println(filepath.Join(c.CacheDir, name))
+		return nil
+	}
+	loc, err := t.RP.NewInstance(name)
+	if err != nil {
+		return err
+	}
+	rc, err := loc.Get()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	f, err := os.Create(out)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func transcodeCommand(ctx context.Context, c config, args []string) error {
+	var opts struct {
+		Path       string        `help:"the file within the torrent, for torrent inputs"`
+		Preset     string        `help:"output options from the configured presets, before any -opt"`
+		Opt        []string      `help:"an output option for ffmpeg"`
+		InOpt      []string      `help:"an input option for ffmpeg"`
+		Start      time.Duration `help:"transcode a clip starting here"`
+		End        time.Duration `help:"transcode a clip ending here"`
+		Seek       string        `help:"how clips start: accurate, or keyframe which is faster"`
+		Audio      string        `help:"extract audio only, from the default track, a track index, or a language"`
+		Tag        []string      `help:"for -audio, a tag to set, as key=value"`
+		StripTags  bool          `help:"for -audio, don't copy the input's tags"`
+		StripCover bool          `help:"for -audio, don't copy the input's cover art"`
+		Loudnorm   floatFlag     `help:"for -audio, normalize to this loudness in LUFS, such as -16"`
+		Out        string        `help:"copy the output here, rather than printing where it's cached"`
+		tagflag.StartPos
+		Input  string `help:"an HTTP URL, magnet URI or infohash"`
+		Format string `help:"the output format, such as mp4"`
+	}
+	parseCommandArgs(&opts, "transcode", args)
+	var tags map[string]string
+	for _, tag := range opts.Tag {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok {
+			return fmt.Errorf("invalid tag %q", tag)
+		}
+		if tags == nil {
+			tags = make(map[string]string)
+		}
+		tags[k] = v
+	}
+	preset, ok := c.Presets[opts.Preset]
+	if opts.Preset != "" && !ok {
+		return fmt.Errorf("unknown preset %q", opts.Preset)
+	}
+	return runLocally(ctx, c, client.Request{
+		Input:        opts.Input,
+		Path:         opts.Path,
+		Format:       opts.Format,
+		Options:      append(append([]string(nil), preset...), opts.Opt...),
+		InputOptions: opts.InOpt,
+		Start:        opts.Start,
+		End:          opts.End,
+		Seek:         opts.Seek,
+		Audio:        opts.Audio,
+		Tags:         tags,
+		StripTags:    opts.StripTags,
+		StripCover:   opts.StripCover,
+		Loudnorm:     float64(opts.Loudnorm),
+	}, opts.Out)
+}
+
+// Extracts a poster frame as a JPEG with services.Poster, which caches it alongside outputs.
+// Torrent inputs are read through a gateway served on a local port.
+func posterCommand(ctx context.Context, c config, args []string) error {
+	var opts struct {
+		Path string `help:"the file within the torrent, for torrent inputs"`
+		Out  string `help:"copy the image here, rather than printing where it's cached"`
+		tagflag.StartPos
+		Input string `help:"an HTTP URL, file, magnet URI or infohash"`
+	}
+	parseCommandArgs(&opts, "poster", args)
+	if err := c.findTools(); err != nil {
+		return err
+	}
+	t, cleanup, err := newTranscoder(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	input := opts.Input
+	if t.TorrentClient != nil && torrents.IsRef(input) {
+		l, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			return err
+		}
+		srv := &http.Server{Handler: &gateway.Handler{Client: t.TorrentClient}}
+		go srv.Serve(l)
+		defer srv.Close()
+		input = (&url.URL{
+			Scheme:   "http",
+			Host:     l.Addr().String(),
+			Path:     "/file",
+			RawQuery: url.Values{"magnet": {input}, "path": {opts.Path}}.Encode(),
+		}).String()
+	}
+	p := services.Poster{Store: t.RP}
+	rc, err := p.Get(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if opts.Out == "" {
+		fmt.Println(filepath.Join(c.CacheDir, services.NewPosterInstance(input).HashName()))
+		return nil
+	}
+	f, err := os.Create(opts.Out)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, rc)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Prints ffprobe's description of the input as JSON.
+func probeCommand(ctx context.Context, c config, args []string) error {
+	var opts struct {
+		tagflag.StartPos
+		Input string `help:"a URL or file ffprobe can read"`
+	}
+	parseCommandArgs(&opts, "probe", args)
+	info, err := transcoder.Probe(ctx, c.FFprobePath, opts.Input)
+	if err != nil {
+		return err
+	}
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(info)
+}
+
+// Lists or removes cached outputs. Run it while the server is stopped, as the server doesn't see
+// changes to the cache made by other processes.
+func cacheCommand(c config, args []string) error {
+	var opts struct {
+		OlderThan  time.Duration `help:"for gc, remove outputs not used for this long"`
+		Superseded bool          `help:"for gc, remove outputs from other generations or ffmpeg versions"`
+		tagflag.StartPos
+		Action string   `help:"ls, rm or gc"`
+		Names  []string `arity:"*" help:"outputs to remove"`
+	}
+	parseCommandArgs(&opts, "cache", args)
+	fc, err := filecache.NewCache(c.CacheDir)
+	if err != nil {
+		return err
+	}
+	var items []filecache.ItemInfo
+	fc.WalkItems(func(ii filecache.ItemInfo) {
+		items = append(items, ii)
+	})
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Accessed.Before(items[j].Accessed)
+	})
+	// Only what's needed to name and remove outputs.
+	t := &transcoder.Transcoder{
+		RP:                 fc.AsResourceProvider(),
+		FFmpegPath:         c.FFmpegPath,
+		Generation:         c.Generation,
+		KeyByFFmpegVersion: c.KeyByFFmpegVersion,
+		InputNormalization: c.InputNormalization,
+	}
+	switch opts.Action {
+	case "ls":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tACCESSED")
+		for _, ii := range items {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", ii.Path, humanize.Bytes(uint64(ii.Size)), humanize.Time(ii.Accessed))
+		}
+		info := fc.Info()
+		fmt.Fprintf(tw, "%d items\t%s\t\n", info.NumItems, humanize.Bytes(uint64(info.Filled)))
+		return tw.Flush()
+	case "rm":
+		for _, name := range opts.Names {
+			if _, err := fc.Stat(name); err != nil {
+				return fmt.Errorf("no cached output %q", name)
+			}
+			if err := t.RemoveOutput(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "gc":
+		before := fc.Info()
+		if opts.OlderThan != 0 {
+			for _, ii := range items {
+				name := fmt.Sprint(ii.Path)
+				if transcoder.IsOutputName(name) && time.Since(ii.Accessed) > opts.OlderThan {
+					if err := t.RemoveOutput(name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if opts.Superseded {
+			for _, ii := range items {
+				name := fmt.Sprint(ii.Path)
+				if transcoder.IsOutputName(name) && t.Superseded(name) {
+					if err := t.RemoveOutput(name); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if c.CacheCapacity > 0 {
+			fc.SetCapacity(c.CacheCapacity.Int64())
+			fc.TrimToCapacity()
+		}
+		after := fc.Info()
+		fmt.Printf(
+			"removed %d items, %s\n",
+			before.NumItems-after.NumItems,
+			humanize.Bytes(uint64(before.Filled-after.Filled)))
+		return nil
+	}
+	return fmt.Errorf("unknown cache action %q", opts.Action)
+}
+
+// The URL of the server this config is for.
+func (c *config) serverURL() string {
+	host, port, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return c.Addr
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	scheme := "http"
+	if c.TLSCertFile != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// Lists the jobs running on a server.
+func jobsCommand(ctx context.Context, c config, args []string) error {
+	var opts struct {
+		Server string `help:"the transcoder's URL, defaults to the configured address"`
+	}
+	parseCommandArgs(&opts, "jobs", args)
+	if opts.Server == "" {
+		opts.Server = c.serverURL()
+	}
+	jobs, err := (&client.Client{URL: opts.Server}).Jobs(ctx)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "OUTPUT\tPRIORITY\tCLIENT\tSTARTED\tWAITERS\tPROGRESS\tINPUT")
+	for _, j := range jobs {
+		input := j.Input
+		if j.InputPath != "" {
+			input += " " + j.InputPath
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			j.OutputName, j.Priority, j.Client, humanize.Time(j.Started), j.Waiters,
+			describeProgress(j.Progress), input)
+	}
+	return tw.Flush()
+}
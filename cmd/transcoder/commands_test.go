@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder"
+)
+
+func TestDescribeProgress(t *testing.T) {
+	qtc := qt.New(t)
+	qtc.Check(describeProgress(transcoder.Progress{}), qt.Equals, "starting")
+	qtc.Check(describeProgress(transcoder.Progress{Downloading: true, DownloadProgress: 0.4}), qt.Equals, "downloading 40%")
+	// Probing happens alongside conversion.
+	qtc.Check(describeProgress(transcoder.Progress{
+		Probing:        true,
+		Converting:     true,
+		ConvertPos:     90 * time.Second,
+		InputDuration:  10 * time.Minute,
+		OutputDuration: 10 * time.Minute,
+	}), qt.Equals, "converting 1m30s/10m0s")
+	// Clips are converted towards their own length.
+	qtc.Check(describeProgress(transcoder.Progress{
+		Converting:     true,
+		ConvertPos:     90 * time.Second,
+		InputDuration:  10 * time.Minute,
+		OutputDuration: 2 * time.Minute,
+	}), qt.Equals, "converting 1m30s/2m0s")
+	// Torrent inputs are still downloading as they're converted.
+	qtc.Check(describeProgress(transcoder.Progress{
+		Downloading:      true,
+		DownloadProgress: 0.3,
+		Pieces:           10,
+		PiecesComplete:   3,
+		Converting:       true,
+		ConvertPos:       90 * time.Second,
+		OutputDuration:   10 * time.Minute,
+	}), qt.Equals, "converting 1m30s/10m0s, 3/10 pieces")
+	qtc.Check(describeProgress(transcoder.Progress{Storing: true, StoreProgress: g.Some(0.5)}), qt.Equals, "storing 50%")
+	qtc.Check(describeProgress(transcoder.Progress{Ready: true}), qt.Equals, "ready")
+}
+
+func TestServerURL(t *testing.T) {
+	qtc := qt.New(t)
+	c := defaultConfig()
+	qtc.Check(c.serverURL(), qt.Equals, "http://localhost:54228")
+	c.Addr = ":8443"
+	c.TLSCertFile = "cert.pem"
+	qtc.Check(c.serverURL(), qt.Equals, "https://localhost:8443")
+}
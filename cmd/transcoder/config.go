@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/tagflag"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder"
+)
+
+// A duration given as a string such as "5m".
+type duration time.Duration
+
+func (d *duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	*d = duration(v)
+	return err
+}
+
+// The settings of the command, read from the file given by -config. Sizes are strings such as
+// "2GiB".
+type config struct {
+	Addr string
+	// Serve HTTPS with this certificate and key.
+	TLSCertFile string `json:",omitempty"`
+	TLSKeyFile  string `json:",omitempty"`
+
+	CacheDir string
+	// The most the cache may hold before evicting outputs. Zero is unlimited.
+	CacheCapacity tagflag.Bytes `json:",omitempty"`
+	// Where running jobs keep their inputs, logs and journals.
+	OutputDir   string
+	FFmpegPath  string `json:",omitempty"`
+	FFprobePath string `json:",omitempty"`
+	// Enables magnet and infohash inputs, storing torrent data here.
+	TorrentDataDir string `json:",omitempty"`
+	// Empty disables history.
+	HistoryFile string `json:",omitempty"`
+
+	Webhooks []string `json:",omitempty"`
+	// Host patterns that requests can name in the webhook query parameter.
+	WebhookHosts  []string `json:",omitempty"`
+	WebhookSecret string   `json:",omitempty"`
+
+	StallTimeout duration
+	// Keyed by stage: download, probe, convert or store.
+	StageTimeouts map[string]duration `json:",omitempty"`
+	Limits        limits
+
+	MaxJobs    int `json:",omitempty"`
+	MaxQueued  int `json:",omitempty"`
+	MaxWaiting int `json:",omitempty"`
+	// How requests are attributed to clients for scheduling. See transcoder.Transcoder.
+	ClientHeader     string `json:",omitempty"`
+	TrustClientParam bool   `json:",omitempty"`
+	OnDisconnect     transcoder.DisconnectPolicy
+	DisconnectGrace  duration
+
+	AllowedOrigins []string            `json:",omitempty"`
+	RecoverJobs    bool                `json:",omitempty"`
+	Presets        map[string][]string `json:",omitempty"`
+	// Replaces the default audio formats. See transcoder.DefaultAudioFormats.
+	AudioFormats map[string]transcoder.AudioFormat `json:",omitempty"`
+	InputPolicy  transcoder.InputPolicy
+	// How inputs are reduced to the identity hashed into output names.
+	InputNormalization transcoder.InputNormalization
+	// Hashed into output names. Change it to stop serving outputs made before, such as after
+	// fixing a preset.
+	Generation         string `json:",omitempty"`
+	KeyByFFmpegVersion bool   `json:",omitempty"`
+
+	// Don't verify the certificates of servers inputs are fetched from.
+	InsecureSkipVerify bool `json:",omitempty"`
+	// PEM certificates trusted in addition to the system's.
+	CAFile string `json:",omitempty"`
+
+	LogLevel log.Level
+}
+
+// transcoder.ResourceLimits with human-friendly units.
+type limits struct {
+	Threads      int           `json:",omitempty"`
+	Nice         int           `json:",omitempty"`
+	IOClass      int           `json:",omitempty"`
+	IOPriority   int           `json:",omitempty"`
+	MaxMemory    tagflag.Bytes `json:",omitempty"`
+	MaxCPUTime   duration      `json:",omitempty"`
+	Cgroup       string        `json:",omitempty"`
+	CgroupCPUs   float64       `json:",omitempty"`
+	CgroupMemory tagflag.Bytes `json:",omitempty"`
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:            "localhost:54228",
+		CacheDir:        "filecache",
+		OnDisconnect:    transcoder.CancelUnwatched,
+		DisconnectGrace: duration(time.Minute),
+		LogLevel:        log.Info,
+	}
+}
+
+// Reads the file over the defaults. Unknown fields are errors, so typos aren't silently ignored.
+func loadConfig(path string) (c config, err error) {
+	c = defaultConfig()
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	err = d.Decode(&c)
+	if err != nil {
+		err = fmt.Errorf("parsing %q: %w", path, err)
+	}
+	return
+}
+
+func (c *config) validate() error {
+	if c.Addr == "" {
+		return fmt.Errorf("no listen address")
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return fmt.Errorf("TLS certificate and key must be given together")
+	}
+	if c.TLSCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile); err != nil {
+			return fmt.Errorf("loading TLS certificate: %w", err)
+		}
+	}
+	if c.CacheDir == "" {
+		return fmt.Errorf("no cache directory")
+	}
+	if c.CacheCapacity < 0 {
+		return fmt.Errorf("negative cache capacity")
+	}
+	for stage := range c.StageTimeouts {
+		switch stage {
+		case "download", "probe", "convert", "store":
+		default:
+			return fmt.Errorf("unknown stage %q in stage timeouts", stage)
+		}
+	}
+	if c.Limits.IOClass < 0 || c.Limits.IOClass > 3 {
+		return fmt.Errorf("IO class %d is not between 0 and 3", c.Limits.IOClass)
+	}
+	if c.Limits.IOPriority < 0 || c.Limits.IOPriority > 7 {
+		return fmt.Errorf("IO priority %d is not between 0 and 7", c.Limits.IOPriority)
+	}
+	if c.MaxJobs < 0 || c.MaxQueued < 0 || c.MaxWaiting < 0 {
+		return fmt.Errorf("negative job limit")
+	}
+	switch c.OnDisconnect {
+	case transcoder.CancelUnwatched, transcoder.ContinueUnwatched, transcoder.GraceUnwatched:
+	default:
+		return fmt.Errorf("unknown disconnect policy %q", c.OnDisconnect)
+	}
+	for name := range c.Presets {
+		if name == "" {
+			return fmt.Errorf("preset with no name")
+		}
+	}
+	for name, f := range c.AudioFormats {
+		if name == "" || len(f.Options) == 0 {
+			return fmt.Errorf("audio format %q has no name or options", name)
+		}
+	}
+	if c.CAFile != "" {
+		if _, err := c.certPool(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Checks that ffmpeg and ffprobe can be run. Only commands that use them need them.
+func (c *config) findTools() error {
+	for _, exe := range []struct{ flag, path, def string }{
+		{"ffmpeg", c.FFmpegPath, "ffmpeg"},
+		{"ffprobe", c.FFprobePath, "ffprobe"},
+	} {
+		path := exe.path
+		if path == "" {
+			path = exe.def
+		}
+		if _, err := exec.LookPath(path); err != nil {
+			return fmt.Errorf("finding %s: %w", exe.flag, err)
+		}
+	}
+	return nil
+}
+
+func (c *config) certPool() (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	b, err := os.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates in %q", c.CAFile)
+	}
+	return pool, nil
+}
+
+func (c *config) stageTimeouts() map[string]time.Duration {
+	ret := make(map[string]time.Duration, len(c.StageTimeouts))
+	for stage, d := range c.StageTimeouts {
+		ret[stage] = time.Duration(d)
+	}
+	return ret
+}
+
+func (l limits) resourceLimits() transcoder.ResourceLimits {
+	return transcoder.ResourceLimits{
+		Threads:      l.Threads,
+		Nice:         l.Nice,
+		IOClass:      l.IOClass,
+		IOPriority:   l.IOPriority,
+		MaxMemory:    l.MaxMemory.Int64(),
+		MaxCPUTime:   time.Duration(l.MaxCPUTime),
+		Cgroup:       l.Cgroup,
+		CgroupCPUs:   l.CgroupCPUs,
+		CgroupMemory: l.CgroupMemory.Int64(),
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/tagflag"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	path := filepath.Join(t.TempDir(), "config.json")
+	qt.Assert(t, os.WriteFile(path, []byte(s), 0600), qt.IsNil)
+	return path
+}
+
+func TestConfig(t *testing.T) {
+	qtc := qt.New(t)
+	c, err := loadConfig(writeConfig(t, `{
+		"CacheCapacity": "2GiB",
+		"StallTimeout": "5m",
+		"StageTimeouts": {"convert": "1h"},
+		"Limits": {"MaxMemory": "1GB", "IOClass": 3},
+		"Presets": {"small": ["-vf", "scale=-2:480"]},
+		"InputPolicy": {"Schemes": ["https"]},
+		"LogLevel": "warning",
+		"FFmpegPath": "sh",
+		"FFprobePath": "sh"
+	}`))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(c.Addr, qt.Equals, defaultConfig().Addr)
+	qtc.Check(c.CacheCapacity.Int64(), qt.Equals, int64(2<<30))
+	qtc.Check(c.StallTimeout, qt.Equals, duration(5*time.Minute))
+	qtc.Check(c.stageTimeouts()["convert"], qt.Equals, time.Hour)
+	qtc.Check(c.Limits.resourceLimits().MaxMemory, qt.Equals, int64(1e9))
+	qtc.Check(c.LogLevel, qt.Equals, log.Warning)
+	qtc.Check(c.InputPolicy.Schemes, qt.DeepEquals, []string{"https"})
+	qtc.Check(c.validate(), qt.IsNil)
+	qtc.Check(c.findTools(), qt.IsNil)
+
+	args := []string{
+		"-addr=:80",
+		"-convertTimeout=1m",
+		"-preset=tiny=-vf scale=-2:240",
+		"-allowScheme=http",
+		"-hostAlias=CDN2.example.com=cdn.example.com",
+		"-logLevel=debug",
+		"-stallTimeout=0",
+		"serve",
+		"-cacheDir=ignored",
+	}
+	var f flags
+	qtc.Assert(tagflag.ParseErr(&f, args), qt.IsNil)
+	qtc.Assert(f.apply(&c, givenFlags(args)), qt.IsNil)
+	qtc.Check(c.Addr, qt.Equals, ":80")
+	qtc.Check(c.CacheDir, qt.Equals, defaultConfig().CacheDir)
+	// Zero values given as flags override the config.
+	qtc.Check(c.StallTimeout, qt.Equals, duration(0))
+	qtc.Check(c.stageTimeouts()["convert"], qt.Equals, time.Minute)
+	qtc.Check(c.Presets["tiny"], qt.DeepEquals, []string{"-vf", "scale=-2:240"})
+	qtc.Check(c.Presets["small"], qt.HasLen, 2)
+	qtc.Check(c.InputPolicy.Schemes, qt.DeepEquals, []string{"https", "http"})
+	qtc.Check(c.InputNormalization.HostAliases, qt.DeepEquals, map[string]string{"cdn2.example.com": "cdn.example.com"})
+	qtc.Check(c.LogLevel, qt.Equals, log.Debug)
+}
+
+func TestConfigErrors(t *testing.T) {
+	qtc := qt.New(t)
+	_, err := loadConfig(writeConfig(t, `{"Adr": ":80"}`))
+	qtc.Check(err, qt.ErrorMatches, `parsing ".*": json: unknown field "Adr"`)
+	_, err = loadConfig(writeConfig(t, `{"StallTimeout": "5 minutes"}`))
+	qtc.Check(err, qt.ErrorMatches, `parsing .*time: unknown unit .*`)
+
+	valid := defaultConfig()
+	valid.FFmpegPath = "sh"
+	valid.FFprobePath = "sh"
+	for _, tc := range []struct {
+		modify func(*config)
+		err    string
+	}{
+		{func(c *config) { c.OnDisconnect = "ignore" }, `unknown disconnect policy "ignore"`},
+		{func(c *config) { c.StageTimeouts = map[string]duration{"upload": 1} }, `unknown stage "upload" in stage timeouts`},
+		{func(c *config) { c.Limits.IOPriority = 8 }, `IO priority 8 is not between 0 and 7`},
+		{func(c *config) { c.TLSCertFile = "cert.pem" }, `TLS certificate and key must be given together`},
+		{func(c *config) { c.CAFile = "nonexistent.pem" }, `open nonexistent.pem: .*`},
+		{func(c *config) { c.AudioFormats = map[string]transcoder.AudioFormat{"wav": {}} }, `audio format "wav" has no name or options`},
+	} {
+		c := valid
+		tc.modify(&c)
+		qtc.Check(c.validate(), qt.ErrorMatches, tc.err)
+	}
+	missing := valid
+	missing.FFmpegPath = "nonexistent-ffmpeg"
+	qtc.Check(missing.validate(), qt.IsNil)
+	qtc.Check(missing.findTools(), qt.ErrorMatches, `finding ffmpeg: .*`)
+	qtc.Check(flags{Preset: []string{"small"}}.apply(&valid, nil), qt.ErrorMatches, `invalid preset "small"`)
+	qtc.Check(flags{LogLevel: "loud"}.apply(&valid, map[string]bool{"logLevel": true}), qt.ErrorMatches, `unknown log level: "loud"`)
+}
+
+func TestFlagNames(t *testing.T) {
+	qtc := qt.New(t)
+	var f flags
+	qtc.Assert(tagflag.ParseErr(&f, []string{"-ffmpeg=/opt/ffmpeg", "-ffprobe=/opt/ffprobe", "-cgroupCpus=1.5"}), qt.IsNil)
+	qtc.Check(f.FFmpeg, qt.Equals, "/opt/ffmpeg")
+	qtc.Check(f.FFprobe, qt.Equals, "/opt/ffprobe")
+	qtc.Check(f.CgroupCPUs, qt.Equals, floatFlag(1.5))
+	// The names apply looks for.
+	for _, name := range []string{
+		"addr", "tlsCert", "tlsKey", "cacheDir", "cacheCapacity", "outputDir", "torrentDataDir",
+		"webhookSecret", "historyFile", "stallTimeout", "downloadTimeout", "probeTimeout",
+		"convertTimeout", "storeTimeout", "threads", "nice", "ioClass", "ioPriority", "maxMemory",
+		"maxCpuTime", "cgroup", "cgroupMemory", "maxJobs", "maxQueued", "maxWaiting",
+		"clientHeader", "trustClientParam", "onDisconnect", "disconnectGrace", "recoverJobs",
+		"denyTorrents", "insecureSkipVerify", "caFile", "generation", "keyByFFmpegVersion",
+		"logLevel",
+	} {
+		qtc.Check(tagflag.ParseErr(&f, []string{"-" + name + "=1"}), qt.Not(qt.ErrorMatches), `.*unknown flag.*`)
+	}
+}
+
+func TestFalseFlagOverridesConfig(t *testing.T) {
+	qtc := qt.New(t)
+	c := defaultConfig()
+	c.RecoverJobs = true
+	args := []string{"-recoverJobs=false"}
+	var f flags
+	qtc.Assert(tagflag.ParseErr(&f, args), qt.IsNil)
+	qtc.Assert(f.apply(&c, givenFlags(args)), qt.IsNil)
+	qtc.Check(c.RecoverJobs, qt.IsFalse)
+}
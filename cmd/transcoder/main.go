@@ -1,30 +1,351 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/anacrolix/envpprof"
+	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/expect"
 	"github.com/anacrolix/missinggo/httptoo"
 	"github.com/anacrolix/missinggo/v2/filecache"
 	"github.com/anacrolix/tagflag"
+	"github.com/anacrolix/torrent"
 
 	"github.com/anacrolix/webtorrent-public/services/transcoder"
 )
 
+// A float64 flag, which tagflag can't parse itself.
+type floatFlag float64
+
+func (f *floatFlag) Marshal(s string) error {
+	v, err := strconv.ParseFloat(s, 64)
+	*f = floatFlag(v)
+	return err
+}
+
+func (*floatFlag) RequiresExplicitValue() bool {
+	return true
+}
+
+// Command-line flags. Those that are set override the config file.
+type flags struct {
+	Config             string `help:"JSON config file, see config in config.go"`
+	Addr               string
+	TLSCert            string        `help:"serve HTTPS with this certificate"`
+	TLSKey             string        `help:"key for -tlsCert"`
+	CacheDir           string        `help:"where outputs are stored"`
+	CacheCapacity      tagflag.Bytes `help:"evict outputs beyond this size"`
+	OutputDir          string        `help:"where running jobs keep their inputs and logs"`
+	FFmpeg             string        `name:"ffmpeg" help:"ffmpeg executable"`
+	FFprobe            string        `name:"ffprobe" help:"ffprobe executable"`
+	TorrentDataDir     string        `help:"enables magnet and infohash inputs, storing torrent data here"`
+	Webhook            []string      `help:"URL notified when any transcode finishes"`
+	WebhookHost        []string      `help:"host patterns requests may give webhooks for"`
+	WebhookSecret      string        `help:"key used to sign webhook payloads"`
+	HistoryFile        string        `help:"where finished jobs are recorded"`
+	StallTimeout       time.Duration `help:"kill jobs that make no progress for this long"`
+	DownloadTimeout    time.Duration
+	ProbeTimeout       time.Duration
+	ConvertTimeout     time.Duration
+	StoreTimeout       time.Duration
+	Threads            int           `help:"ffmpeg threads per job"`
+	Nice               int           `help:"niceness of ffmpeg, 0 for nice's default"`
+	IOClass            int           `help:"ionice class of ffmpeg: 1 realtime, 2 best-effort, 3 idle"`
+	IOPriority         int           `help:"ionice priority of ffmpeg within its class, 0 to 7"`
+	MaxMemory          tagflag.Bytes `help:"address space limit for ffmpeg"`
+	MaxCPUTime         time.Duration `help:"CPU time limit for ffmpeg"`
+	Cgroup             string        `help:"cgroup v2 directory to create per-job cgroups in"`
+	CgroupCPUs         floatFlag     `name:"cgroupCpus" help:"CPUs each job's cgroup may use"`
+	CgroupMemory       tagflag.Bytes `help:"memory limit of each job's cgroup"`
+	MaxJobs            int           `help:"transcodes run at once, 0 for unlimited"`
+	MaxQueued          int           `help:"queued jobs beyond which new transcodes are refused, 0 for unlimited"`
+	MaxWaiting         int           `help:"waiting requests beyond which new transcodes are refused, 0 for unlimited"`
+	ClientHeader       string        `help:"header set by a trusted proxy that identifies clients for scheduling"`
+	TrustClientParam   bool          `help:"identify clients for scheduling by the client query parameter"`
+	AllowOrigin        []string      `help:"origin patterns allowed cross-origin access, such as https://*.example.com or *"`
+	RecoverJobs        bool          `help:"restart jobs interrupted by a previous run"`
+	Preset             []string      `help:"output options prefetch entries can name, as name=space separated options"`
+	OnDisconnect       string        `help:"what to do with a job nobody is waiting on: cancel, continue or grace"`
+	DisconnectGrace    time.Duration `help:"how long unwatched jobs survive with -onDisconnect=grace"`
+	AllowScheme        []string      `help:"URL schemes inputs may use instead of http and https"`
+	AllowHost          []string      `help:"host patterns inputs may be fetched from"`
+	DenyTorrents       bool          `help:"refuse magnet and infohash inputs"`
+	HostAlias          []string      `help:"treat a host as another in output names, as alias=canonical"`
+	VolatileParam      []string      `help:"query parameter patterns left out of output names, such as token or utm_*"`
+	Gateway            []string      `help:"host patterns of torrent gateways, whose URLs are named like torrent inputs"`
+	InsecureSkipVerify bool          `help:"don't verify the certificates of input servers"`
+	CAFile             string        `help:"PEM certificates to trust for input servers"`
+	Generation         string        `help:"hashed into output names, change it to stop serving older outputs"`
+	KeyByFFmpegVersion bool          `help:"hash the ffmpeg version into output names"`
+	LogLevel           string        `help:"debug, info, warning or error"`
+	tagflag.StartPos
+	Command string `arity:"?" help:"serve (the default), transcode, poster, probe, cache or jobs; -h after it for its usage"`
+	Args    tagflag.ExcessArgs
+}
+
+// Returns the names of the flags given before the command.
+func givenFlags(args []string) map[string]bool {
+	given := make(map[string]bool)
+	for _, a := range args {
+		if a == "--" || len(a) < 2 || a[0] != '-' {
+			break
+		}
+		name, _, _ := strings.Cut(a[1:], "=")
+		given[name] = true
+	}
+	return given
+}
+
+// Overrides the config with the flags that were given, even where they're given zero values.
+func (f flags) apply(c *config, given map[string]bool) error {
+	setString := func(name string, dst *string, v string) {
+		if given[name] {
+			*dst = v
+		}
+	}
+	setInt := func(name string, dst *int, v int) {
+		if given[name] {
+			*dst = v
+		}
+	}
+	setBool := func(name string, dst *bool, v bool) {
+		if given[name] {
+			*dst = v
+		}
+	}
+	setDuration := func(name string, dst *duration, v time.Duration) {
+		if given[name] {
+			*dst = duration(v)
+		}
+	}
+	setBytes := func(name string, dst *tagflag.Bytes, v tagflag.Bytes) {
+		if given[name] {
+			*dst = v
+		}
+	}
+	setString("addr", &c.Addr, f.Addr)
+	setString("tlsCert", &c.TLSCertFile, f.TLSCert)
+	setString("tlsKey", &c.TLSKeyFile, f.TLSKey)
+	setString("cacheDir", &c.CacheDir, f.CacheDir)
+	setBytes("cacheCapacity", &c.CacheCapacity, f.CacheCapacity)
+	setString("outputDir", &c.OutputDir, f.OutputDir)
+	setString("ffmpeg", &c.FFmpegPath, f.FFmpeg)
+	setString("ffprobe", &c.FFprobePath, f.FFprobe)
+	setString("torrentDataDir", &c.TorrentDataDir, f.TorrentDataDir)
+	c.Webhooks = append(c.Webhooks, f.Webhook...)
+	c.WebhookHosts = append(c.WebhookHosts, f.WebhookHost...)
+	setString("webhookSecret", &c.WebhookSecret, f.WebhookSecret)
+	setString("historyFile", &c.HistoryFile, f.HistoryFile)
+	setDuration("stallTimeout", &c.StallTimeout, f.StallTimeout)
+	for stage, d := range map[string]time.Duration{
+		"download": f.DownloadTimeout,
+		"probe":    f.ProbeTimeout,
+		"convert":  f.ConvertTimeout,
+		"store":    f.StoreTimeout,
+	} {
+		if !given[stage+"Timeout"] {
+			continue
+		}
+		if c.StageTimeouts == nil {
+			c.StageTimeouts = make(map[string]duration)
+		}
+		c.StageTimeouts[stage] = duration(d)
+	}
+	setInt("threads", &c.Limits.Threads, f.Threads)
+	setInt("nice", &c.Limits.Nice, f.Nice)
+	setInt("ioClass", &c.Limits.IOClass, f.IOClass)
+	setInt("ioPriority", &c.Limits.IOPriority, f.IOPriority)
+	setBytes("maxMemory", &c.Limits.MaxMemory, f.MaxMemory)
+	setDuration("maxCpuTime", &c.Limits.MaxCPUTime, f.MaxCPUTime)
+	setString("cgroup", &c.Limits.Cgroup, f.Cgroup)
+	if given["cgroupCpus"] {
+		c.Limits.CgroupCPUs = float64(f.CgroupCPUs)
+	}
+	setBytes("cgroupMemory", &c.Limits.CgroupMemory, f.CgroupMemory)
+	setInt("maxJobs", &c.MaxJobs, f.MaxJobs)
+	setInt("maxQueued", &c.MaxQueued, f.MaxQueued)
+	setInt("maxWaiting", &c.MaxWaiting, f.MaxWaiting)
+	setString("clientHeader", &c.ClientHeader, f.ClientHeader)
+	setBool("trustClientParam", &c.TrustClientParam, f.TrustClientParam)
+	if given["onDisconnect"] {
+		c.OnDisconnect = transcoder.DisconnectPolicy(f.OnDisconnect)
+	}
+	setDuration("disconnectGrace", &c.DisconnectGrace, f.DisconnectGrace)
+	c.AllowedOrigins = append(c.AllowedOrigins, f.AllowOrigin...)
+	setBool("recoverJobs", &c.RecoverJobs, f.RecoverJobs)
+	for _, p := range f.Preset {
+		name, opts, ok := strings.Cut(p, "=")
+		if !ok {
+			return fmt.Errorf("invalid preset %q", p)
+		}
+		if c.Presets == nil {
+			c.Presets = make(map[string][]string)
+		}
+		c.Presets[name] = strings.Fields(opts)
+	}
+	c.InputPolicy.Schemes = append(c.InputPolicy.Schemes, f.AllowScheme...)
+	c.InputPolicy.Hosts = append(c.InputPolicy.Hosts, f.AllowHost...)
+	setBool("denyTorrents", &c.InputPolicy.DenyTorrents, f.DenyTorrents)
+	for _, a := range f.HostAlias {
+		alias, canonical, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("invalid host alias %q", a)
+		}
+		if c.InputNormalization.HostAliases == nil {
+			c.InputNormalization.HostAliases = make(map[string]string)
+		}
+		c.InputNormalization.HostAliases[strings.ToLower(alias)] = canonical
+	}
+	c.InputNormalization.VolatileParams = append(c.InputNormalization.VolatileParams, f.VolatileParam...)
+	c.InputNormalization.Gateways = append(c.InputNormalization.Gateways, f.Gateway...)
+	setBool("insecureSkipVerify", &c.InsecureSkipVerify, f.InsecureSkipVerify)
+	setString("caFile", &c.CAFile, f.CAFile)
+	setString("generation", &c.Generation, f.Generation)
+	setBool("keyByFFmpegVersion", &c.KeyByFFmpegVersion, f.KeyByFFmpegVersion)
+	if given["logLevel"] {
+		if err := c.LogLevel.UnmarshalText([]byte(f.LogLevel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func main() {
-	var args = struct {
-		Addr string
-	}{
-		Addr: "localhost:54228",
+	var f flags
+	tagflag.Parse(&f, tagflag.Description(
+		"Serves transcodes over HTTP, or runs one of the other commands. "+
+			"Flags before the command apply to all of them."))
+	c, err := loadConfig(f.Config)
+	if err == nil {
+		err = f.apply(&c, givenFlags(os.Args[1:]))
+	}
+	if err == nil {
+		err = c.validate()
+	}
+	if err != nil {
+		fatal(fmt.Errorf("invalid configuration: %w", err))
+	}
+	log.Default = log.Default.FilterLevel(c.LogLevel)
+	tlsConfig := httptoo.ClientTLSConfig(http.DefaultClient)
+	tlsConfig.InsecureSkipVerify = c.InsecureSkipVerify
+	if c.CAFile != "" {
+		tlsConfig.RootCAs, err = c.certPool()
+		expect.Nil(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	switch f.Command {
+	case "", "serve":
+		err = serve(c)
+	case "transcode":
+		err = transcodeCommand(ctx, c, f.Args)
+	case "poster":
+		err = posterCommand(ctx, c, f.Args)
+	case "probe":
+		err = probeCommand(ctx, c, f.Args)
+	case "cache":
+		err = cacheCommand(c, f.Args)
+	case "jobs":
+		err = jobsCommand(ctx, c, f.Args)
+	default:
+		err = fmt.Errorf("unknown command %q", f.Command)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	log.Levelf(log.Critical, "%v", err)
+	os.Exit(1)
+}
+
+// Returns a transcoder configured by c, and a function that releases what it holds.
+func newTranscoder(c config) (t *transcoder.Transcoder, cleanup func(), err error) {
+	fc, err := filecache.NewCache(c.CacheDir)
+	if err != nil {
+		return
 	}
-	tagflag.Parse(&args)
-	fc, err := filecache.NewCache("filecache")
-	expect.Nil(err)
-	t := &transcoder.Transcoder{
-		RP: fc.AsResourceProvider(),
+	if c.CacheCapacity > 0 {
+		fc.SetCapacity(c.CacheCapacity.Int64())
+	}
+	t = &transcoder.Transcoder{
+		RP:                 fc.AsResourceProvider(),
+		OutputDir:          c.OutputDir,
+		FFmpegPath:         c.FFmpegPath,
+		FFprobePath:        c.FFprobePath,
+		Webhooks:           c.Webhooks,
+		WebhookHosts:       c.WebhookHosts,
+		WebhookSecret:      c.WebhookSecret,
+		StallTimeout:       time.Duration(c.StallTimeout),
+		StageTimeouts:      c.stageTimeouts(),
+		Limits:             c.Limits.resourceLimits(),
+		DisconnectPolicy:   c.OnDisconnect,
+		DisconnectGrace:    time.Duration(c.DisconnectGrace),
+		MaxJobs:            c.MaxJobs,
+		MaxQueued:          c.MaxQueued,
+		MaxWaiting:         c.MaxWaiting,
+		ClientHeader:       c.ClientHeader,
+		TrustClientParam:   c.TrustClientParam,
+		AllowedOrigins:     c.AllowedOrigins,
+		RecoverJobs:        c.RecoverJobs,
+		Presets:            c.Presets,
+		AudioFormats:       c.AudioFormats,
+		InputPolicy:        c.InputPolicy,
+		CustomInputTLS:     c.InsecureSkipVerify || c.CAFile != "",
+		InputNormalization: c.InputNormalization,
+		Generation:         c.Generation,
+		KeyByFFmpegVersion: c.KeyByFFmpegVersion,
+	}
+	cleanup = func() {}
+	if c.TorrentDataDir != "" {
+		cfg := torrent.NewDefaultClientConfig()
+		cfg.DataDir = c.TorrentDataDir
+		var cl *torrent.Client
+		cl, err = torrent.NewClient(cfg)
+		if err != nil {
+			return
+		}
+		t.TorrentClient = cl
+		cleanup = func() { cl.Close() }
+	}
+	return
+}
+
+func serve(c config) error {
+	if err := c.findTools(); err != nil {
+		return err
+	}
+	t, cleanup, err := newTranscoder(c)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if c.HistoryFile != "" {
+		t.History, err = transcoder.OpenHistory(c.HistoryFile)
+		if err != nil {
+			return err
+		}
 	}
 	t.Init()
-	httptoo.ClientTLSConfig(http.DefaultClient).InsecureSkipVerify = true
-	expect.Nil(http.ListenAndServe(args.Addr, t))
+	// Problems fail /readyz rather than stopping the server.
+	caps := t.CheckCapabilities(context.Background())
+	log.Printf("using %s", caps.FFmpegVersion)
+	for _, p := range caps.Problems {
+		log.Printf("not ready: %s", p)
+	}
+	if err := t.Recover(); err != nil {
+		return err
+	}
+	if c.TLSCertFile != "" {
+		return http.ListenAndServeTLS(c.Addr, c.TLSCertFile, c.TLSKeyFile, t)
+	}
+	return http.ListenAndServe(c.Addr, t)
 }
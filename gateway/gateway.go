@@ -0,0 +1,267 @@
+// Package gateway serves files from torrents over HTTP.
+package gateway
+
+import (
+	"errors"
+	"html/template"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/torrent"
+
+	wtpub "github.com/anacrolix/webtorrent-public"
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
+
+// Serves torrent files with paths like /<infohash>/file?path=<file path>, and directory listings
+// with /<infohash>/dir?path=<dir path>. Magnet URIs can be given instead of an infohash with
+// /file?magnet=<magnet uri>&path=<file path>.
+type Handler struct {
+	Client *torrent.Client
+	// How long torrents the handler added are kept after their last request ends, so that players'
+	// successive range requests don't each fetch the info and pieces again. Defaults to
+	// DefaultIdleTimeout.
+	IdleTimeout time.Duration
+
+	mu   sync.Mutex
+	held map[*torrent.Torrent]*heldTorrent
+}
+
+const DefaultIdleTimeout = 5 * time.Minute
+
+// A torrent kept in the client between requests.
+type heldTorrent struct {
+	release  func()
+	requests int
+	idle     *time.Timer
+}
+
+// Keeps the torrent while the request is served, and until IdleTimeout after the last one ends.
+// release is from torrents.Add.
+func (h *Handler) hold(t *torrent.Torrent, release func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ht := h.held[t]
+	if ht != nil {
+		// The held release keeps the torrent.
+		release()
+		if ht.idle != nil {
+			ht.idle.Stop()
+			ht.idle = nil
+		}
+		ht.requests++
+		return
+	}
+	if h.held == nil {
+		h.held = make(map[*torrent.Torrent]*heldTorrent)
+	}
+	h.held[t] = &heldTorrent{release: release, requests: 1}
+}
+
+func (h *Handler) unhold(t *torrent.Torrent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ht := h.held[t]
+	ht.requests--
+	if ht.requests != 0 {
+		return
+	}
+	timeout := h.IdleTimeout
+	if timeout == 0 {
+		timeout = DefaultIdleTimeout
+	}
+	ht.idle = time.AfterFunc(timeout, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if ht.requests == 0 && h.held[t] == ht {
+			delete(h.held, t)
+			ht.release()
+		}
+	})
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var ref, action string
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch len(parts) {
+	case 1:
+		ref = q.Get("magnet")
+		action = parts[0]
+	case 2:
+		ref = parts[0]
+		action = parts[1]
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if !torrents.IsRef(ref) {
+		http.Error(w, "bad torrent reference", http.StatusBadRequest)
+		return
+	}
+	switch action {
+	case "file", "dir":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	t, release, err := torrents.Add(r.Context(), h.Client, ref)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("error adding torrent %q: %v", ref, err)
+			http.Error(w, "error adding torrent", http.StatusBadRequest)
+		}
+		return
+	}
+	h.hold(t, release)
+	defer h.unhold(t)
+	if action == "dir" {
+		serveDir(w, r, t, q.Get("path"))
+		return
+	}
+	f, err := torrents.File(t, q.Get("path"))
+	if errors.Is(err, torrents.ErrFileNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	serveFile(w, r, f)
+}
+
+// Extensions for media types that aren't reliably in the system mime tables.
+var mediaTypes = map[string]string{
+	".avi":  "video/x-msvideo",
+	".flac": "audio/flac",
+	".m4a":  "audio/mp4",
+	".m4v":  "video/mp4",
+	".mkv":  "video/x-matroska",
+	".mov":  "video/quicktime",
+	".mp3":  "audio/mpeg",
+	".mp4":  "video/mp4",
+	".ogg":  "audio/ogg",
+	".opus": "audio/ogg",
+	".srt":  "application/x-subrip",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt",
+	".webm": "video/webm",
+}
+
+func contentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if ct, ok := mediaTypes[ext]; ok {
+		return ct
+	}
+	return mime.TypeByExtension(ext)
+}
+
+const (
+	minReadahead = 1 << 20
+	maxReadahead = 32 << 20
+)
+
+// Media players read mostly sequentially at roughly the bitrate, but seek around when starting
+// playback and probing containers. Readahead grows with the length of the current contiguous read,
+// so seeks don't waste bandwidth on data that won't be read, while steady playback gets ahead of
+// the swarm.
+func mediaReadahead(rc torrent.ReadaheadContext) int64 {
+	ra := (rc.CurrentPos - rc.ContiguousReadStartPos) / 2
+	if ra < minReadahead {
+		return minReadahead
+	}
+	if ra > maxReadahead {
+		return maxReadahead
+	}
+	return ra
+}
+
+func serveFile(w http.ResponseWriter, r *http.Request, f *torrent.File) {
+	name := path.Base(f.DisplayPath())
+	if ct := contentType(name); ct != "" {
+		w.Header().Set("Content-Type", ct)
+	}
+	tr := f.NewReader()
+	defer tr.Close()
+	tr.SetReadaheadFunc(mediaReadahead)
+	tr.SetResponsive()
+	http.ServeContent(w, r, name, time.Time{}, wtpub.ContextReader{Ctx: r.Context(), R: tr})
+}
+
+type dirEntry struct {
+	Name   string
+	Path   string
+	IsDir  bool
+	Length int64
+}
+
+// Returns the immediate children of dir. Padding files are omitted.
+func dirEntries(t *torrent.Torrent, dir string) (ret []dirEntry) {
+	dir = strings.Trim(dir, "/")
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	dirs := make(map[string]bool)
+	for _, f := range torrents.Files(t) {
+		p := f.DisplayPath()
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rel := strings.TrimPrefix(p, prefix)
+		if i := strings.IndexByte(rel, '/'); i >= 0 {
+			name := rel[:i]
+			if !dirs[name] {
+				dirs[name] = true
+				ret = append(ret, dirEntry{Name: name, Path: prefix + name, IsDir: true})
+			}
+			continue
+		}
+		ret = append(ret, dirEntry{Name: rel, Path: p, Length: f.Length()})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].IsDir != ret[j].IsDir {
+			return ret[i].IsDir
+		}
+		return ret[i].Name < ret[j].Name
+	})
+	return
+}
+
+var dirTemplate = template.Must(template.New("dir").Parse(`<!DOCTYPE html>
+<title>{{.Name}}/{{.Dir}}</title>
+<ul>
+{{- range .Entries}}
+{{- if .IsDir}}
+<li><a href="dir?path={{.Path}}{{with $.Magnet}}&magnet={{.}}{{end}}">{{.Name}}/</a></li>
+{{- else}}
+<li><a href="file?path={{.Path}}{{with $.Magnet}}&magnet={{.}}{{end}}">{{.Name}}</a> {{.Length}}</li>
+{{- end}}
+{{- end}}
+</ul>
+`))
+
+func serveDir(w http.ResponseWriter, r *http.Request, t *torrent.Torrent, dir string) {
+	entries := dirEntries(t, dir)
+	if len(entries) == 0 && strings.Trim(dir, "/") != "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err := dirTemplate.Execute(w, struct {
+		Name    string
+		Dir     string
+		Magnet  string
+		Entries []dirEntry
+	}{t.Name(), dir, r.URL.Query().Get("magnet"), entries})
+	if err != nil {
+		log.Printf("error executing dir template: %v", err)
+	}
+}
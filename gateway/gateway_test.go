@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestServeFileFromSeeder(t *testing.T) {
+	qtc := qt.New(t)
+	content := strings.Repeat("webtorrent", 10000)
+	seedDir := t.TempDir()
+	qtc.Assert(os.MkdirAll(filepath.Join(seedDir, "show", "Season 1"), 0750), qt.IsNil)
+	qtc.Assert(os.WriteFile(filepath.Join(seedDir, "show", "Season 1", "episode.mkv"), []byte(content), 0640), qt.IsNil)
+	qtc.Assert(os.WriteFile(filepath.Join(seedDir, "show", "notes.txt"), []byte("notes"), 0640), qt.IsNil)
+	info := metainfo.Info{PieceLength: 1 << 14}
+	qtc.Assert(info.BuildFromFilePath(filepath.Join(seedDir, "show")), qt.IsNil)
+	var mi metainfo.MetaInfo
+	var err error
+	mi.InfoBytes, err = bencode.Marshal(info)
+	qtc.Assert(err, qt.IsNil)
+
+	seederConfig := torrent.TestingConfig(t)
+	seederConfig.Seed = true
+	seederConfig.DataDir = seedDir
+	// TestingConfig allows less than a chunk, which stalls serving.
+	seederConfig.MaxAllocPeerRequestDataPerConn = 1 << 20
+	seeder, err := torrent.NewClient(seederConfig)
+	qtc.Assert(err, qt.IsNil)
+	defer seeder.Close()
+	seederTorrent, err := seeder.AddTorrent(&mi)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(seederTorrent.VerifyData(), qt.IsNil)
+
+	leecher, err := torrent.NewClient(torrent.TestingConfig(t))
+	qtc.Assert(err, qt.IsNil)
+	defer leecher.Close()
+	leecherTorrent, err := leecher.AddTorrent(&mi)
+	qtc.Assert(err, qt.IsNil)
+	leecherTorrent.AddClientPeer(seeder)
+
+	srv := httptest.NewServer(&Handler{Client: leecher})
+	defer srv.Close()
+	ih := mi.HashInfoBytes().HexString()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/"+ih+"/file?"+url.Values{
+		"path": {"Season 1/episode.mkv"},
+	}.Encode(), nil)
+	qtc.Assert(err, qt.IsNil)
+	req.Header.Set("Range", "bytes=20000-20009")
+	resp, err := http.DefaultClient.Do(req)
+	qtc.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	qtc.Check(resp.StatusCode, qt.Equals, http.StatusPartialContent)
+	qtc.Check(resp.Header.Get("Content-Type"), qt.Equals, "video/x-matroska")
+	b, err := io.ReadAll(resp.Body)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, content[20000:20010])
+
+	resp, err = http.Get(srv.URL + "/" + ih + "/file?path=missing")
+	qtc.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	qtc.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	resp, err = http.Get(srv.URL + "/" + ih + "/dir")
+	qtc.Assert(err, qt.IsNil)
+	b, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Contains, "Season 1/")
+	qtc.Check(string(b), qt.Contains, "notes.txt")
+	qtc.Check(string(b), qt.Not(qt.Contains), "episode.mkv")
+}
+
+func TestDirEntriesHidePadding(t *testing.T) {
+	qtc := qt.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	qtc.Assert(err, qt.IsNil)
+	defer cl.Close()
+	info := metainfo.Info{
+		Name:        "season",
+		PieceLength: 1 << 14,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"a", "episode.mkv"}, Length: 100},
+			{Path: []string{".pad", "16284"}, Length: 16284},
+			{Path: []string{"b.srt"}, Length: 10},
+		},
+	}
+	info.Pieces = make([]byte, 20*2)
+	var mi metainfo.MetaInfo
+	mi.InfoBytes, err = bencode.Marshal(info)
+	qtc.Assert(err, qt.IsNil)
+	tor, err := cl.AddTorrent(&mi)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(dirEntries(tor, ""), qt.DeepEquals, []dirEntry{
+		{Name: "a", Path: "a", IsDir: true},
+		{Name: "b.srt", Path: "b.srt", Length: 10},
+	})
+	qtc.Check(dirEntries(tor, "a/"), qt.DeepEquals, []dirEntry{
+		{Name: "episode.mkv", Path: "a/episode.mkv", Length: 100},
+	})
+}
+
+func TestHeldTorrentsReleasedWhenIdle(t *testing.T) {
+	qtc := qt.New(t)
+	h := &Handler{IdleTimeout: 10 * time.Millisecond}
+	tor := new(torrent.Torrent)
+	released := make(chan int, 2)
+	h.hold(tor, func() { released <- 1 })
+	h.unhold(tor)
+	// A request within the timeout keeps the first reader, and drops its own.
+	h.hold(tor, func() { released <- 2 })
+	qtc.Check(<-released, qt.Equals, 2)
+	time.Sleep(20 * time.Millisecond)
+	qtc.Check(released, qt.HasLen, 0)
+	h.unhold(tor)
+	qtc.Check(<-released, qt.Equals, 1)
+	h.mu.Lock()
+	qtc.Check(h.held, qt.HasLen, 0)
+	h.mu.Unlock()
+}
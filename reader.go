@@ -0,0 +1,29 @@
+package wtpub
+
+import (
+	"context"
+	"io"
+)
+
+// Stops reading when the context is done. Readers that take a context themselves, like torrent
+// readers, are given it, so blocked reads return too. Seeks pass through, for http.ServeContent.
+type ContextReader struct {
+	Ctx context.Context
+	R   io.ReadSeeker
+}
+
+func (me ContextReader) Read(b []byte) (int, error) {
+	if rc, ok := me.R.(interface {
+		ReadContext(context.Context, []byte) (int, error)
+	}); ok {
+		return rc.ReadContext(me.Ctx, b)
+	}
+	if me.Ctx.Err() != nil {
+		return 0, context.Cause(me.Ctx)
+	}
+	return me.R.Read(b)
+}
+
+func (me ContextReader) Seek(offset int64, whence int) (int64, error) {
+	return me.R.Seek(offset, whence)
+}
@@ -0,0 +1,88 @@
+// Package api has what both the transcoder and its clients need: the types it exchanges over HTTP,
+// and how requests are named. It imports little besides the standard library, so clients don't pull
+// in the transcoder's dependencies.
+package api
+
+import (
+	"time"
+
+	g "github.com/anacrolix/generics"
+)
+
+type Progress struct {
+	Ready            bool
+	Downloading      bool
+	DownloadProgress float64
+	// Piece counts for the input file when it's streamed from a torrent.
+	Pieces         int
+	PiecesComplete int
+	Probing        bool
+	// Measuring the loudness of audio-only outputs before conversion.
+	Analyzing     bool
+	AnalyzePos    time.Duration
+	Converting    bool
+	ConvertPos    time.Duration
+	InputDuration time.Duration
+	// What ConvertPos is converting towards: the length of the clip, or InputDuration for whole
+	// inputs.
+	OutputDuration time.Duration
+	Queued         bool
+	Storing        bool
+	StoreProgress  g.Option[float64]
+	// Increases whenever the progress of any operation changes. Zero for outputs that are ready.
+	Version uint64
+}
+
+type Priority string
+
+const (
+	// Someone is waiting to play the output. This is the default.
+	PriorityInteractive Priority = "interactive"
+	// The output is likely to be wanted soon.
+	PriorityPrefetch Priority = "prefetch"
+	// Bulk work that can wait.
+	PriorityBatch Priority = "batch"
+)
+
+// A running job, as listed by GET /jobs.
+type JobStatus struct {
+	OutputName string
+	Input      string
+	InputPath  string `json:",omitempty"`
+	Format     string
+	Priority   Priority
+	Client     string `json:",omitempty"`
+	Started    time.Time
+	// Jobs that aren't detached are cancelled according to the DisconnectPolicy when nobody is
+	// waiting on them.
+	Detached bool
+	Waiters  int
+	Progress Progress
+}
+
+// Where to find a submitted job.
+type JobRef struct {
+	OutputName string
+	// Where the output can be fetched from once complete.
+	URL string
+	// The progress event stream.
+	EventsURL string
+}
+
+// Records what went into an output's name.
+type OutputKey struct {
+	OutputName string
+	// The strings hashed, in order, to make the name. The format is the name's extension.
+	Hashed        []string
+	Generation    string `json:",omitempty"`
+	FFmpegVersion string `json:",omitempty"`
+}
+
+// Served by /explain.
+type KeyExplanation struct {
+	OutputKey
+	Cached  bool
+	Running bool
+	// The key the cached output was stored with, if any.
+	Stored *OutputKey `json:",omitempty"`
+}
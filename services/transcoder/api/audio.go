@@ -0,0 +1,87 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// An audio-only output, from the audio, tags, tag, cover and loudnorm query parameters.
+type AudioExtraction struct {
+	// "default" for the input's default audio track, an index among its audio tracks, or a
+	// language such as "eng".
+	Track     string
+	StripTags bool `json:",omitempty"`
+	// Tags set on the output, replacing any copied from the input. Empty values remove tags.
+	Tags       map[string]string `json:",omitempty"`
+	StripCover bool              `json:",omitempty"`
+	// Normalize to this integrated loudness in LUFS, such as -16, measuring the track first. Zero
+	// leaves the loudness alone.
+	Loudnorm float64 `json:",omitempty"`
+}
+
+// Returns nil if the query isn't for audio only.
+func AudioFromQuery(q url.Values) (a *AudioExtraction, err error) {
+	if q.Get("audio") == "" {
+		return
+	}
+	a = &AudioExtraction{Track: q.Get("audio")}
+	switch q.Get("tags") {
+	case "", "copy":
+	case "strip":
+		a.StripTags = true
+	default:
+		return nil, fmt.Errorf("tags must be copy or strip, not %q", q.Get("tags"))
+	}
+	switch q.Get("cover") {
+	case "", "copy":
+	case "strip":
+		a.StripCover = true
+	default:
+		return nil, fmt.Errorf("cover must be copy or strip, not %q", q.Get("cover"))
+	}
+	for _, tag := range q["tag"] {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid tag %q, want key=value", tag)
+		}
+		if a.Tags == nil {
+			a.Tags = make(map[string]string)
+		}
+		a.Tags[k] = v
+	}
+	if s := q.Get("loudnorm"); s != "" {
+		a.Loudnorm, err = strconv.ParseFloat(s, 64)
+		if err != nil || a.Loudnorm < -70 || a.Loudnorm > -5 {
+			return nil, fmt.Errorf("loudnorm must be between -70 and -5 LUFS, not %q", s)
+		}
+	}
+	return
+}
+
+func (a *AudioExtraction) HashedStrings() (ret []string) {
+	if a == nil {
+		return
+	}
+	ret = append(ret, "audio="+a.Track)
+	if a.StripTags {
+		ret = append(ret, "tags=strip")
+	}
+	keys := make([]string, 0, len(a.Tags))
+	for k := range a.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ret = append(ret, "tag="+k+"="+a.Tags[k])
+	}
+	if a.StripCover {
+		ret = append(ret, "cover=strip")
+	}
+	if a.Loudnorm != 0 {
+		ret = append(ret, "loudnorm="+strconv.FormatFloat(a.Loudnorm, 'f', -1, 64))
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAudioFromQuery(t *testing.T) {
+	qtc := qt.New(t)
+	a, err := AudioFromQuery(url.Values{})
+	qtc.Check(a, qt.IsNil)
+	qtc.Check(err, qt.IsNil)
+	a, err = AudioFromQuery(url.Values{
+		"audio":    {"eng"},
+		"tags":     {"strip"},
+		"tag":      {"title=Episode 1", "artist="},
+		"loudnorm": {"-16"},
+	})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(a, qt.DeepEquals, &AudioExtraction{
+		Track:     "eng",
+		StripTags: true,
+		Tags:      map[string]string{"title": "Episode 1", "artist": ""},
+		Loudnorm:  -16,
+	})
+	qtc.Check(a.HashedStrings(), qt.DeepEquals, []string{
+		"audio=eng", "tags=strip", "tag=artist=", "tag=title=Episode 1", "loudnorm=-16",
+	})
+	for q, want := range map[string]string{
+		"audio=0&tags=keep":   `tags must be copy or strip, not "keep"`,
+		"audio=0&cover=keep":  `cover must be copy or strip, not "keep"`,
+		"audio=0&tag=title":   `invalid tag "title", want key=value`,
+		"audio=0&loudnorm=0":  `loudnorm must be between -70 and -5 LUFS, not "0"`,
+		"audio=0&loudnorm=-x": `loudnorm must be between -70 and -5 LUFS, not "-x"`,
+	} {
+		v, _ := url.ParseQuery(q)
+		_, err := AudioFromQuery(v)
+		qtc.Check(err, qt.ErrorMatches, want, qt.Commentf("%v", q))
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Seek modes for clips, given by the seek query parameter.
+const (
+	// Start exactly at the requested time. The input is decoded from the keyframe before it.
+	SeekAccurate = "accurate"
+	// Start at the keyframe before the requested time, which is faster. Stream copies always do
+	// this, as they can't start between keyframes.
+	SeekKeyframe = "keyframe"
+)
+
+// A range of the input to transcode, from the start and end query parameters.
+type Clip struct {
+	Start time.Duration
+	// Zero means the end of the input.
+	End time.Duration
+	// As given. Empty chooses by the output options.
+	Seek string
+}
+
+// Parses a clip time, as a Go duration such as "1m30s", or seconds such as "90.5".
+func parseClipTime(s string) (time.Duration, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return d, nil
+	}
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+func ClipFromQuery(q url.Values) (c Clip, err error) {
+	if s := q.Get("start"); s != "" {
+		c.Start, err = parseClipTime(s)
+		if err != nil {
+			return
+		}
+	}
+	if s := q.Get("end"); s != "" {
+		c.End, err = parseClipTime(s)
+		if err != nil {
+			return
+		}
+	}
+	c.Seek = q.Get("seek")
+	switch {
+	case c.Start < 0:
+		err = errors.New("start is negative")
+	case c.End != 0 && c.End <= c.Start:
+		err = errors.New("end is not after start")
+	case c.Seek != "" && c.Seek != SeekAccurate && c.Seek != SeekKeyframe:
+		err = fmt.Errorf("unknown seek mode %q", c.Seek)
+	}
+	return
+}
+
+func (c Clip) IsSet() bool {
+	return c.Start != 0 || c.End != 0
+}
+
+// Hashed into the output name. Empty for whole inputs, so their names don't change.
+func (c Clip) HashedStrings() (ret []string) {
+	if !c.IsSet() {
+		return nil
+	}
+	ret = append(ret, "start="+c.Start.String(), "end="+c.End.String())
+	if c.Seek != "" {
+		ret = append(ret, "seek="+c.Seek)
+	}
+	return
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClipFromQuery(t *testing.T) {
+	qtc := qt.New(t)
+	c, err := ClipFromQuery(url.Values{"start": {"1m30s"}, "end": {"120.5"}, "seek": {"keyframe"}})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(c, qt.Equals, Clip{Start: 90 * time.Second, End: 120500 * time.Millisecond, Seek: SeekKeyframe})
+	qtc.Check(c.HashedStrings(), qt.DeepEquals, []string{"start=1m30s", "end=2m0.5s", "seek=keyframe"})
+	qtc.Check(Clip{}.HashedStrings(), qt.IsNil)
+	for q, want := range map[string]string{
+		"start=soon":             `invalid time "soon"`,
+		"start=-1":               "start is negative",
+		"start=10&end=10":        "end is not after start",
+		"end=5&seek=exactly":     `unknown seek mode "exactly"`,
+		"start=1&end=2&seek=%20": `unknown seek mode " "`,
+	} {
+		v, _ := url.ParseQuery(q)
+		_, err := ClipFromQuery(v)
+		qtc.Check(err, qt.ErrorMatches, want, qt.Commentf("%v", q))
+	}
+}
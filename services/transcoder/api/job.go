@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/url"
+)
+
+// The parameters of a request that determine its output.
+type Job struct {
+	// An HTTP URL, magnet URI or infohash, from the i query parameter.
+	Input string
+	// The file within the torrent, when the input is a magnet URI or infohash.
+	InputPath string
+	Format    string
+	// ffmpeg output and input options, from the opt and iopt query parameters.
+	Options      []string
+	InputOptions []string
+	Clip         Clip
+	// Set for audio-only outputs.
+	Audio *AudioExtraction
+}
+
+// Returns the job given by a request's query. The error says why its clip or audio parameters are
+// invalid. The rest of the job is filled in regardless.
+func ParseJob(q url.Values) (j Job, err error) {
+	j.Input = reencodeURL(q.Get("i"))
+	j.InputPath = q.Get("path")
+	j.Format = q.Get("f")
+	j.Options = q["opt"]
+	j.InputOptions = q["iopt"]
+	j.Clip, err = ClipFromQuery(q)
+	if err == nil {
+		j.Audio, err = AudioFromQuery(q)
+	}
+	return
+}
+
+func reencodeURL(s string) string {
+	url_, err := url.Parse(s)
+	if err != nil || url_.Scheme == "" {
+		// Infohashes, and anything else that isn't a URL, are used as given.
+		return s
+	}
+	url_.RawQuery = url_.Query().Encode()
+	return url_.String()
+}
+
+// The strings hashed to make the output name, given what the input and its path are identified as
+// (see InputNormalization.Identity). salt is appended so that outputs made with different settings
+// get different names.
+func (j Job) HashedStrings(identity, identityPath string, salt []string) []string {
+	var hashed []string
+	hashed = append(hashed, j.InputOptions...)
+	hashed = append(hashed, j.Options...)
+	hashed = append(hashed, identity)
+	if identityPath != "" {
+		hashed = append(hashed, identityPath)
+	}
+	hashed = append(hashed, j.Clip.HashedStrings()...)
+	hashed = append(hashed, j.Audio.HashedStrings()...)
+	return append(hashed, salt...)
+}
+
+const HashStringsSize = md5.Size
+
+func HashStrings(ss []string) []byte {
+	h := md5.New()
+	var b []byte
+	for _, s := range ss {
+		b = h.Sum(b[:0])
+		h.Write(b)
+		h.Write([]byte(s))
+	}
+	return h.Sum(b[:0])
+}
+
+// The name of an output from the strings hashed for it, and its format.
+func OutputName(hashed []string, format string) string {
+	return fmt.Sprintf("%x.%s", HashStrings(hashed), format)
+}
+
+// The name a transcoder with no Generation or InputNormalization configured stores the output of a
+// request under. /explain gives the name in other configurations.
+func DefaultOutputName(q url.Values) string {
+	j, _ := ParseJob(q)
+	identity, identityPath := InputNormalization{}.Identity(j.Input, j.InputPath)
+	return OutputName(j.HashedStrings(identity, identityPath, nil), j.Format)
+}
@@ -0,0 +1,16 @@
+package api
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHashStrings(t *testing.T) {
+	qtc := qt.New(t)
+	partsHash := HashStrings([]string{"h", "el", "lo"})
+	oneHash := HashStrings([]string{"hello"})
+	qtc.Check(partsHash, qt.Not(qt.DeepEquals), oneHash)
+	qtc.Check(partsHash, qt.HasLen, HashStringsSize)
+	qtc.Check(oneHash, qt.HasLen, HashStringsSize)
+}
@@ -0,0 +1,142 @@
+package api
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// Rules for reducing inputs to an identity, so that requests for the same content share an output
+// name. Identities are only hashed: inputs are still fetched as given. Regardless of the rules,
+// URLs have their scheme and host lowercased, default ports and fragments removed, and their path
+// and query encoded consistently, and magnet URIs are identified by their infohash.
+type InputNormalization struct {
+	// Maps hosts to the host they're an alias of, such as "cdn2.example.com" to "cdn.example.com".
+	HostAliases map[string]string `json:",omitempty"`
+	// Query parameters that don't affect the content, such as tokens and tracking parameters.
+	// Patterns are matched with path.Match, such as "utm_*".
+	VolatileParams []string `json:",omitempty"`
+	// Hosts serving torrent files like the gateway package, with paths like
+	// /<infohash>/file?path=<file path>. Their URLs are identified by infohash and file path, the
+	// same as torrent inputs.
+	Gateways []string `json:",omitempty"`
+}
+
+// Returns the identity of the input, and of the file path within it.
+func (n InputNormalization) Identity(input, inputPath string) (string, string) {
+	if IsTorrentRef(input) {
+		return torrentIdentity(input), inputPath
+	}
+	u, err := url.Parse(input)
+	if err != nil || u.Scheme == "" || u.Opaque != "" {
+		// Not something we know how to normalize.
+		return input, inputPath
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	host = strings.ToLower(host)
+	if alias, ok := n.HostAliases[host]; ok {
+		host = strings.ToLower(alias)
+	}
+	if u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		port = ""
+	}
+	u.Host = host
+	if port != "" {
+		u.Host = net.JoinHostPort(host, port)
+	}
+	q := u.Query()
+	if matchesAny(n.Gateways, host) {
+		if ih, path, ok := gatewayIdentity(u.Path, q); ok {
+			return ih, path
+		}
+	}
+	for name := range q {
+		if matchesAny(n.VolatileParams, name) {
+			q.Del(name)
+		}
+	}
+	u.RawQuery = q.Encode()
+	// Clearing RawPath makes the path encoded canonically.
+	u.RawPath = ""
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), inputPath
+}
+
+// Whether the input is a magnet URI or hex infohash, which the transcoder fetches with BitTorrent.
+func IsTorrentRef(s string) bool {
+	if strings.HasPrefix(s, "magnet:") {
+		return true
+	}
+	_, err := hex.DecodeString(s)
+	return len(s) == 40 && err == nil
+}
+
+// Magnet URIs are identified by their infohash, as hex like infohash inputs.
+func torrentIdentity(ref string) string {
+	if !strings.HasPrefix(ref, "magnet:") {
+		return strings.ToLower(ref)
+	}
+	if ih, ok := magnetInfohash(ref); ok {
+		return ih
+	}
+	return ref
+}
+
+// Returns the hex v1 infohash of a magnet URI, which may be given in hex or base32.
+func magnetInfohash(uri string) (string, bool) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", false
+	}
+	for _, xt := range u.Query()["xt"] {
+		enc, ok := strings.CutPrefix(xt, "urn:btih:")
+		if !ok {
+			continue
+		}
+		var b []byte
+		switch len(enc) {
+		case 40:
+			b, err = hex.DecodeString(enc)
+		case 32:
+			b, err = base32.StdEncoding.DecodeString(strings.ToUpper(enc))
+		default:
+			continue
+		}
+		if err == nil {
+			return hex.EncodeToString(b), true
+		}
+	}
+	return "", false
+}
+
+// Returns the infohash and file path of a gateway file URL.
+func gatewayIdentity(urlPath string, q url.Values) (ih, path string, ok bool) {
+	parts := strings.Split(strings.Trim(urlPath, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "file" && IsTorrentRef(parts[0]):
+		ih = parts[0]
+	case len(parts) == 1 && parts[0] == "file" && IsTorrentRef(q.Get("magnet")):
+		ih = q.Get("magnet")
+	default:
+		return
+	}
+	return torrentIdentity(ih), q.Get("path"), true
+}
+
+// Matches case-insensitively with path.Match.
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
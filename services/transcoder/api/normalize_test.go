@@ -0,0 +1,40 @@
+package api
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInputIdentity(t *testing.T) {
+	qtc := qt.New(t)
+	n := InputNormalization{
+		HostAliases:    map[string]string{"cdn2.example.com": "cdn.example.com"},
+		VolatileParams: []string{"token", "utm_*"},
+		Gateways:       []string{"*.anacrolix.link"},
+	}
+	const ih = "30764610642571b3c01af11d6ce60cfa164d7ee3"
+	for _, tc := range []struct {
+		input, path   string
+		identity, idp string
+	}{
+		{"HTTP://CDN2.Example.com:80/a%20b/%63.avi?token=x&utm_source=y&b=2&a=1#t=1", "",
+			"http://cdn.example.com/a%20b/c.avi?a=1&b=2", ""},
+		{"https://example.com:8443/a.avi", "", "https://example.com:8443/a.avi", ""},
+		{"http://webtorrent.anacrolix.link/" + ih + "/file?path=Season%204%2fEp%2011.avi", "",
+			ih, "Season 4/Ep 11.avi"},
+		{"http://webtorrent.anacrolix.link/file?magnet=magnet%3A%3Fxt%3Durn%3Abtih%3A" + ih + "&path=a.avi", "",
+			ih, "a.avi"},
+		// Gateway paths are only recognized on configured hosts.
+		{"http://example.com/" + ih + "/file?path=a.avi", "",
+			"http://example.com/" + ih + "/file?path=a.avi", ""},
+		{"magnet:?xt=urn:btih:" + ih + "&dn=x&tr=http://tracker", "a.avi", ih, "a.avi"},
+		{"magnet:?xt=urn:btih:gb3emedeevy3hqa26eowzzqm7ile27xd", "a.avi", ih, "a.avi"},
+		{"30764610642571B3C01AF11D6CE60CFA164D7EE3", "a.avi", ih, "a.avi"},
+		{"mailto:someone@example.com", "", "mailto:someone@example.com", ""},
+	} {
+		id, idp := n.Identity(tc.input, tc.path)
+		qtc.Check(id, qt.Equals, tc.identity, qt.Commentf("%q", tc.input))
+		qtc.Check(idp, qt.Equals, tc.idp, qt.Commentf("%q", tc.input))
+	}
+}
@@ -0,0 +1,260 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// How an audio output is encoded.
+type AudioFormat struct {
+	// ffmpeg output options that encode the audio, such as ["-c:a", "libopus", "-b:a", "128k"].
+	Options []string
+	// Copy the track rather than encoding it when it's already in this codec, such as "flac".
+	CopyCodec string `json:",omitempty"`
+	// Whether the container can hold cover art.
+	CoverArt bool `json:",omitempty"`
+}
+
+// Used when Transcoder.AudioFormats is nil, keyed by output format.
+var DefaultAudioFormats = map[string]AudioFormat{
+	"opus": {Options: []string{"-c:a", "libopus", "-b:a", "128k"}},
+	"m4a":  {Options: []string{"-c:a", "aac", "-b:a", "192k"}, CoverArt: true},
+	"mp3":  {Options: []string{"-c:a", "libmp3lame", "-q:a", "2", "-id3v2_version", "3"}, CoverArt: true},
+	"flac": {Options: []string{"-c:a", "flac"}, CopyCodec: "flac", CoverArt: true},
+}
+
+// Loudness normalization targets, besides integrated loudness which requests give.
+const (
+	loudnormTruePeak = "-1.5"
+	loudnormRange    = "11"
+)
+
+// An audio-only output, from the audio, tags, tag, cover and loudnorm query parameters.
+type AudioExtraction = api.AudioExtraction
+
+func (t *Transcoder) audioFormats() map[string]AudioFormat {
+	if t.AudioFormats != nil {
+		return t.AudioFormats
+	}
+	return DefaultAudioFormats
+}
+
+type stream = map[string]any
+
+func streamInt(s stream, key string) int {
+	f, _ := s[key].(float64)
+	return int(f)
+}
+
+func streamString(s stream, key string) string {
+	v, _ := s[key].(string)
+	return v
+}
+
+func streamTag(s stream, key string) string {
+	tags, _ := s["tags"].(map[string]any)
+	v, _ := tags[key].(string)
+	return v
+}
+
+func streamDisposition(s stream, key string) bool {
+	d, _ := s["disposition"].(map[string]any)
+	v, _ := d[key].(float64)
+	return v != 0
+}
+
+// Picks the audio track by index among the audio tracks, by language, or the default.
+func selectAudioTrack(streams []stream, track string) (stream, error) {
+	var audio []stream
+	for _, s := range streams {
+		if streamString(s, "codec_type") == "audio" {
+			audio = append(audio, s)
+		}
+	}
+	if len(audio) == 0 {
+		return nil, errors.New("input has no audio")
+	}
+	if track == "default" {
+		for _, s := range audio {
+			if streamDisposition(s, "default") {
+				return s, nil
+			}
+		}
+		return audio[0], nil
+	}
+	if i, err := strconv.Atoi(track); err == nil {
+		if i < 0 || i >= len(audio) {
+			return nil, fmt.Errorf("no audio track %d, the input has %d", i, len(audio))
+		}
+		return audio[i], nil
+	}
+	for _, s := range audio {
+		if strings.EqualFold(streamTag(s, "language"), track) {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("no audio track in language %q", track)
+}
+
+// Returns the input's cover art, if any.
+func coverStream(streams []stream) stream {
+	for _, s := range streams {
+		if streamString(s, "codec_type") == "video" && streamDisposition(s, "attached_pic") {
+			return s
+		}
+	}
+	return nil
+}
+
+// What the first loudnorm pass measures.
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// Parses the measurement loudnorm prints at the end of ffmpeg's output with print_format=json.
+func parseLoudnessMeasurement(b []byte) (m loudnessMeasurement, err error) {
+	start := bytes.LastIndexByte(b, '{')
+	end := bytes.LastIndexByte(b, '}')
+	if start == -1 || end < start {
+		err = errors.New("no loudnorm measurement in ffmpeg output")
+		return
+	}
+	err = json.Unmarshal(b[start:end+1], &m)
+	return
+}
+
+func loudnormFilter(target float64) string {
+	return fmt.Sprintf("loudnorm=I=%s:TP=%s:LRA=%s",
+		strconv.FormatFloat(target, 'f', -1, 64), loudnormTruePeak, loudnormRange)
+}
+
+// The second pass filter, which applies the measured correction linearly.
+func (m loudnessMeasurement) filter(target float64) string {
+	return fmt.Sprintf(
+		"%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		loudnormFilter(target), m.InputI, m.InputTP, m.InputLRA, m.InputThresh, m.TargetOffset)
+}
+
+// Runs ffmpeg with the output options, to a null output, returning what it printed.
+type analyzer func(ctx context.Context, opts []string) ([]byte, error)
+
+// Returns the output options for an audio job. The input is probed to pick its track and cover
+// art, and if the job normalizes loudness, the track is analyzed first in the "analyze" stage.
+func (t *Transcoder) audioOptions(
+	ctx context.Context,
+	j job,
+	input string,
+	analyze analyzer,
+	updateProgress func(func(*Progress)),
+) (opts []string, err error) {
+	a := j.audio
+	format, ok := t.audioFormats()[j.format]
+	if !ok {
+		return nil, fmt.Errorf("unknown audio format %q", j.format)
+	}
+	info, err := Probe(ctx, t.FFprobePath, input)
+	if err != nil {
+		return
+	}
+	track, err := selectAudioTrack(info.Streams, a.Track)
+	if err != nil {
+		return
+	}
+	trackMap := fmt.Sprintf("0:%d", streamInt(track, "index"))
+	opts = append(opts, "-map", trackMap)
+	if cover := coverStream(info.Streams); cover != nil && format.CoverArt && !a.StripCover {
+		opts = append(opts,
+			"-map", fmt.Sprintf("0:%d", streamInt(cover, "index")),
+			"-c:v", "copy", "-disposition:v", "attached_pic")
+	}
+	if a.StripTags {
+		opts = append(opts, "-map_metadata", "-1")
+	} else {
+		// The global tags, and the track's own, such as its language.
+		opts = append(opts,
+			"-map_metadata", "0",
+			"-map_metadata:s:a", fmt.Sprintf("0:s:%d", streamInt(track, "index")))
+	}
+	keys := make([]string, 0, len(a.Tags))
+	for k := range a.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		opts = append(opts, "-metadata", k+"="+a.Tags[k])
+	}
+	if a.Loudnorm == 0 {
+		if format.CopyCodec != "" && streamString(track, "codec_name") == format.CopyCodec {
+			return append(opts, "-c:a", "copy"), nil
+		}
+		return append(opts, format.Options...), nil
+	}
+	updateProgress(func(p *Progress) {
+		p.Analyzing = true
+	})
+	out, err := analyze(ctx, []string{
+		"-map", trackMap,
+		"-af", loudnormFilter(a.Loudnorm) + ":print_format=json",
+		"-f", "null",
+	})
+	updateProgress(func(p *Progress) {
+		p.Analyzing = false
+	})
+	if err != nil {
+		return nil, fmt.Errorf("analyzing loudness: %w", err)
+	}
+	m, err := parseLoudnessMeasurement(out)
+	if err != nil {
+		return
+	}
+	opts = append(opts, format.Options...)
+	if m.InputI == "-inf" {
+		log.Printf("not normalizing silent audio for %q", j.outputName)
+		return
+	}
+	// loudnorm resamples to 192kHz, so return to the input's rate.
+	filter := m.filter(a.Loudnorm)
+	if rate := streamString(track, "sample_rate"); rate != "" {
+		filter += ",aresample=" + rate
+	}
+	return append(opts, "-af", filter), nil
+}
+
+// Runs an analysis pass of ffmpeg, returning its output.
+func runAnalysis(ctx context.Context, input string, args []string, cgroup string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	if errors.Is(cmd.Err, exec.ErrDot) {
+		cmd.Err = nil
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	log.Printf("invoking %q", redactArgs(input, args))
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if cgroup != "" {
+		if err := addToCgroup(cgroup, cmd.Process.Pid); err != nil {
+			log.Levelf(log.Warning, "error adding analysis to cgroup: %v", err)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+		return nil, fmt.Errorf("%w: %s", err, lines[len(lines)-1])
+	}
+	return stderr.Bytes(), nil
+}
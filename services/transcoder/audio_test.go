@@ -0,0 +1,143 @@
+package transcoder
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// Describes a video with Japanese and English audio, and cover art.
+const fakeAudioFFprobe = `#!/bin/sh
+case "$*" in
+*-show_streams*) cat <<END
+{
+  "streams": [
+    {"index": 0, "codec_type": "video", "codec_name": "h264"},
+    {"index": 1, "codec_type": "audio", "codec_name": "aac", "sample_rate": "48000",
+      "disposition": {"default": 1}, "tags": {"language": "jpn"}},
+    {"index": 2, "codec_type": "audio", "codec_name": "flac", "sample_rate": "44100",
+      "disposition": {"default": 0}, "tags": {"language": "eng"}},
+    {"index": 3, "codec_type": "video", "codec_name": "mjpeg", "disposition": {"attached_pic": 1}}
+  ],
+  "format": {"duration": "600.000000"}
+}
+END
+;;
+*) echo 600 ;;
+esac
+`
+
+// Prints a loudnorm measurement for analysis passes, and otherwise writes its arguments to the
+// output.
+const fakeAudioFFmpeg = `#!/bin/sh
+for arg; do :; done
+case "$*" in
+*"-f null"*) cat >&2 <<END
+[Parsed_loudnorm_0 @ 0x55d1c0c0c0c0]
+{
+	"input_i" : "-23.50",
+	"input_tp" : "-4.00",
+	"input_lra" : "6.10",
+	"input_thresh" : "-34.00",
+	"output_i" : "-16.02",
+	"target_offset" : "0.02"
+}
+END
+;;
+*) echo "$@" > "$arg" ;;
+esac
+`
+
+func TestSelectAudioTrack(t *testing.T) {
+	qtc := qt.New(t)
+	streams := []stream{
+		{"index": 0.0, "codec_type": "video"},
+		{"index": 1.0, "codec_type": "audio", "tags": map[string]any{"language": "jpn"}},
+		{"index": 2.0, "codec_type": "audio", "tags": map[string]any{"language": "eng"},
+			"disposition": map[string]any{"default": 1.0}},
+	}
+	index := func(track string) any {
+		s, err := selectAudioTrack(streams, track)
+		if err != nil {
+			return err.Error()
+		}
+		return streamInt(s, "index")
+	}
+	qtc.Check(index("default"), qt.Equals, 2)
+	qtc.Check(index("0"), qt.Equals, 1)
+	qtc.Check(index("ENG"), qt.Equals, 2)
+	qtc.Check(index("2"), qt.Equals, "no audio track 2, the input has 2")
+	qtc.Check(index("fre"), qt.Equals, `no audio track in language "fre"`)
+	_, err := selectAudioTrack(streams[:1], "default")
+	qtc.Check(err, qt.ErrorMatches, "input has no audio")
+}
+
+func TestAudioJobs(t *testing.T) {
+	qtc := qt.New(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("input"))
+	}))
+	defer srv.Close()
+	bin := t.TempDir()
+	ffmpeg := filepath.Join(bin, "ffmpeg")
+	qtc.Assert(os.WriteFile(ffmpeg, []byte(fakeAudioFFmpeg), 0755), qt.IsNil)
+	ffprobe := filepath.Join(bin, "ffprobe")
+	qtc.Assert(os.WriteFile(ffprobe, []byte(fakeAudioFFprobe), 0755), qt.IsNil)
+	history, err := OpenHistory(filepath.Join(t.TempDir(), "history.jsonl"))
+	qtc.Assert(err, qt.IsNil)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.FFmpegPath = ffmpeg
+		tc.FFprobePath = ffprobe
+		tc.History = history
+	})
+	run := func(q url.Values) string {
+		q.Set("i", srv.URL+"/show.mkv")
+		name, err := tc.Run(context.Background(), q, func(Progress) {})
+		qtc.Assert(err, qt.IsNil)
+		loc, err := tc.RP.NewInstance(name)
+		qtc.Assert(err, qt.IsNil)
+		rc, err := loc.Get()
+		qtc.Assert(err, qt.IsNil)
+		defer rc.Close()
+		b, err := io.ReadAll(rc)
+		qtc.Assert(err, qt.IsNil)
+		return strings.TrimSpace(string(b))
+	}
+
+	args := run(url.Values{
+		"f":        {"mp3"},
+		"audio":    {"eng"},
+		"tag":      {"title=Episode 1"},
+		"loudnorm": {"-16"},
+	})
+	qtc.Check(args, qt.Contains, " -map 0:2 -map 0:3 -c:v copy -disposition:v attached_pic"+
+		" -map_metadata 0 -map_metadata:s:a 0:s:2 -metadata title=Episode 1 -c:a libmp3lame -q:a 2 -id3v2_version 3"+
+		" -af loudnorm=I=-16:TP=-1.5:LRA=11:measured_I=-23.50:measured_TP=-4.00:measured_LRA=6.10"+
+		":measured_thresh=-34.00:offset=0.02:linear=true,aresample=44100 -progress ")
+	results, err := history.Query(HistoryFilter{})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(results, qt.HasLen, 1)
+	qtc.Check(results[0].Stages["analyze"].Finished.IsZero(), qt.IsFalse)
+	qtc.Check(results[0].Audio.Loudnorm, qt.Equals, -16.0)
+
+	// FLAC tracks are copied to FLAC outputs, and opus can't hold cover art.
+	args = run(url.Values{"f": {"flac"}, "audio": {"1"}, "tags": {"strip"}})
+	qtc.Check(args, qt.Contains, " -map 0:2 -map 0:3 -c:v copy -disposition:v attached_pic -map_metadata -1 -c:a copy -progress ")
+	args = run(url.Values{"f": {"opus"}, "audio": {"default"}})
+	qtc.Check(args, qt.Contains, " -map 0:1 -map_metadata 0 -map_metadata:s:a 0:s:1 -c:a libopus -b:a 128k -progress ")
+
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+url.Values{
+		"i": {srv.URL + "/show.mkv"}, "f": {"wav"}, "audio": {"default"},
+	}.Encode(), nil))
+	qtc.Check(w.Code, qt.Equals, http.StatusBadRequest)
+	qtc.Check(w.Body.String(), qt.Equals, "unknown audio format \"wav\"\n")
+}
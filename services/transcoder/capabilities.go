@@ -0,0 +1,263 @@
+package transcoder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// What the ffmpeg and ffprobe in use can do, as found by CheckCapabilities.
+type Capabilities struct {
+	// The first line of -version output.
+	FFmpegVersion  string
+	FFprobeVersion string
+	Encoders       []string
+	Decoders       []string
+	Muxers         []string
+	Filters        []string
+	// Why the transcoder isn't ready, such as a missing executable or a preset needing an encoder
+	// that isn't available.
+	Problems []string `json:",omitempty"`
+	Checked  time.Time
+}
+
+func (c *Capabilities) addProblem(format string, a ...any) {
+	c.Problems = append(c.Problems, fmt.Sprintf(format, a...))
+}
+
+func (t *Transcoder) ffmpegPath() string {
+	if t.FFmpegPath != "" {
+		return t.FFmpegPath
+	}
+	return "ffmpeg"
+}
+
+func (t *Transcoder) ffprobePath() string {
+	if t.FFprobePath != "" {
+		return t.FFprobePath
+	}
+	return "ffprobe"
+}
+
+// Runs ffmpeg and ffprobe to find what they support, and checks that every preset can be used. The
+// result is served at /capabilities, and /readyz fails until this has been done without problems.
+func (t *Transcoder) CheckCapabilities(ctx context.Context) Capabilities {
+	c := Capabilities{Checked: time.Now()}
+	run := func(exe string, args ...string) []byte {
+		out, err := exec.CommandContext(ctx, exe, append([]string{"-hide_banner"}, args...)...).Output()
+		if err != nil {
+			c.addProblem("running %s %s: %v", exe, strings.Join(args, " "), err)
+		}
+		return out
+	}
+	ffmpeg := t.ffmpegPath()
+	c.FFmpegVersion = firstLine(run(ffmpeg, "-version"))
+	c.FFprobeVersion = firstLine(run(t.ffprobePath(), "-version"))
+	if c.FFmpegVersion != "" {
+		c.Encoders = parseCodecList(run(ffmpeg, "-encoders"))
+		c.Decoders = parseCodecList(run(ffmpeg, "-decoders"))
+		c.Muxers = parseFormatList(run(ffmpeg, "-muxers"))
+		c.Filters = parseFilterList(run(ffmpeg, "-filters"))
+		c.checkPresets("preset", t.Presets)
+		// The default audio formats aren't checked, as not every build has their encoders, and
+		// they're only needed if audio outputs are requested.
+		audio := make(map[string][]string, len(t.AudioFormats))
+		for name, f := range t.AudioFormats {
+			audio[name] = f.Options
+		}
+		c.checkPresets("audio format", audio)
+	}
+	t.mu.Lock()
+	t.capabilities = &c
+	t.mu.Unlock()
+	return c
+}
+
+func firstLine(b []byte) string {
+	line, _, _ := strings.Cut(string(b), "\n")
+	return strings.TrimSpace(line)
+}
+
+// Parses -encoders and -decoders output: a legend, a line of dashes, then flags, name and
+// description.
+func parseCodecList(b []byte) (ret []string) {
+	started := false
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if !started {
+			started = len(fields) == 1 && strings.Trim(fields[0], "-") == ""
+			continue
+		}
+		if len(fields) >= 2 {
+			ret = append(ret, fields[1])
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Parses -muxers output, which is like -encoders except names can be comma separated.
+func parseFormatList(b []byte) (ret []string) {
+	for _, names := range parseCodecList(b) {
+		ret = append(ret, strings.Split(names, ",")...)
+	}
+	sort.Strings(ret)
+	return
+}
+
+// Parses -filters output. Filter lines have flags, the name, and the input and output types
+// separated by "->".
+func parseFilterList(b []byte) (ret []string) {
+	s := bufio.NewScanner(bytes.NewReader(b))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 3 && strings.Contains(fields[2], "->") {
+			ret = append(ret, fields[1])
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+func containsString(sorted []string, s string) bool {
+	i := sort.SearchStrings(sorted, s)
+	return i < len(sorted) && sorted[i] == s
+}
+
+// Checks named sets of output options, such as presets, describing them as kind in problems.
+func (c *Capabilities) checkPresets(kind string, presets map[string][]string) {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		encoders, muxers, filters := optionRequirements(presets[name])
+		for _, e := range encoders {
+			if !containsString(c.Encoders, e) {
+				c.addProblem("%s %q needs missing encoder %q", kind, name, e)
+			}
+		}
+		for _, m := range muxers {
+			if !containsString(c.Muxers, m) {
+				c.addProblem("%s %q needs missing muxer %q", kind, name, m)
+			}
+		}
+		for _, f := range filters {
+			if !containsString(c.Filters, f) {
+				c.addProblem("%s %q needs missing filter %q", kind, name, f)
+			}
+		}
+	}
+}
+
+// Returns the encoders, muxers and filters that ffmpeg output options refer to.
+func optionRequirements(opts []string) (encoders, muxers, filters []string) {
+	for i := 0; i+1 < len(opts); i++ {
+		flag, value := opts[i], opts[i+1]
+		switch {
+		case flag == "-f":
+			muxers = append(muxers, value)
+		case flag == "-c", flag == "-codec", flag == "-vcodec", flag == "-acodec", flag == "-scodec",
+			strings.HasPrefix(flag, "-c:"), strings.HasPrefix(flag, "-codec:"):
+			if value != "copy" {
+				encoders = append(encoders, value)
+			}
+		case flag == "-vf", flag == "-af", flag == "-filter_complex", strings.HasPrefix(flag, "-filter:"):
+			filters = append(filters, filterNames(value)...)
+		default:
+			continue
+		}
+		i++
+	}
+	return
+}
+
+// Returns the names of the filters in a filtergraph, such as "scale" in "[0:v]scale=-2:480[out]".
+func filterNames(graph string) (ret []string) {
+	var (
+		filter  strings.Builder
+		quoted  bool
+		escaped bool
+	)
+	flush := func() {
+		f := filter.String()
+		filter.Reset()
+		// Strip input labels.
+		for strings.HasPrefix(f, "[") {
+			end := strings.Index(f, "]")
+			if end == -1 {
+				return
+			}
+			f = strings.TrimSpace(f[end+1:])
+		}
+		name, _, _ := strings.Cut(f, "=")
+		name, _, _ = strings.Cut(name, "[")
+		name, _, _ = strings.Cut(name, "@")
+		if name = strings.TrimSpace(name); name != "" {
+			ret = append(ret, name)
+		}
+	}
+	for _, r := range graph {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '\'':
+			quoted = !quoted
+		case !quoted && (r == ',' || r == ';'):
+			flush()
+			continue
+		}
+		filter.WriteRune(r)
+	}
+	flush()
+	return
+}
+
+// Always succeeds while the process is serving requests.
+func (t *Transcoder) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Succeeds once capabilities have been checked without problems.
+func (t *Transcoder) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	c := t.capabilities
+	t.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	switch {
+	case c == nil:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "capabilities not checked")
+	case len(c.Problems) != 0:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		for _, p := range c.Problems {
+			fmt.Fprintln(w, p)
+		}
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+func (t *Transcoder) serveCapabilities(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	c := t.capabilities
+	t.mu.Unlock()
+	if c == nil {
+		http.Error(w, "capabilities not checked", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
@@ -0,0 +1,113 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// Prints canned ffmpeg listings for its last argument.
+const fakeFFmpeg = `#!/bin/sh
+for arg; do :; done
+case "$arg" in
+-version) echo "ffmpeg version 6.0 Copyright (c) 2000-2023 the FFmpeg developers" ;;
+-encoders) cat <<END
+Encoders:
+ V..... = Video
+ ------
+ V....D libx264              libx264 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10 (codec h264)
+ A....D aac                  AAC (Advanced Audio Coding)
+END
+;;
+-decoders) cat <<END
+Decoders:
+ ------
+ V....D h264                 H.264 / AVC / MPEG-4 AVC / MPEG-4 part 10
+END
+;;
+-muxers) cat <<END
+File formats:
+ D. = Demuxing supported
+ .E = Muxing supported
+ --
+  E mp4             MP4 (MPEG-4 Part 14)
+  E matroska,webm   Matroska
+END
+;;
+-filters) cat <<END
+Filters:
+  T.. = Timeline support
+  | = Source or sink filter
+ ..C scale             V->V       Scale the input video size and/or convert the image format.
+ TSC select            V->V       Select video frames to pass in output.
+END
+;;
+esac
+`
+
+func TestCapabilities(t *testing.T) {
+	qtc := qt.New(t)
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	qtc.Assert(os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0755), qt.IsNil)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.FFmpegPath = ffmpeg
+		tc.FFprobePath = ffmpeg
+		tc.Presets = map[string][]string{
+			"h264": {"-c:v", "libx264", "-c:a", "aac", "-vf", "[0:v]scale=-2:480,select='eq(n\\,0)'"},
+			"copy": {"-c", "copy", "-f", "webm"},
+		}
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	qtc.Check(get("/healthz").Code, qt.Equals, http.StatusOK)
+	qtc.Check(get("/readyz").Code, qt.Equals, http.StatusServiceUnavailable)
+	qtc.Check(get("/capabilities").Code, qt.Equals, http.StatusNotFound)
+
+	c := tc.CheckCapabilities(context.Background())
+	qtc.Check(c.FFmpegVersion, qt.Equals, "ffmpeg version 6.0 Copyright (c) 2000-2023 the FFmpeg developers")
+	qtc.Check(c.Encoders, qt.DeepEquals, []string{"aac", "libx264"})
+	qtc.Check(c.Decoders, qt.DeepEquals, []string{"h264"})
+	qtc.Check(c.Muxers, qt.DeepEquals, []string{"matroska", "mp4", "webm"})
+	qtc.Check(c.Filters, qt.DeepEquals, []string{"scale", "select"})
+	qtc.Check(c.Problems, qt.HasLen, 0)
+	qtc.Check(get("/readyz").Code, qt.Equals, http.StatusOK)
+	w := get("/capabilities")
+	qtc.Assert(w.Code, qt.Equals, http.StatusOK)
+	var served Capabilities
+	qtc.Assert(json.NewDecoder(w.Body).Decode(&served), qt.IsNil)
+	qtc.Check(served.Muxers, qt.DeepEquals, c.Muxers)
+
+	tc.Presets["hevc"] = []string{"-c:v", "libx265", "-f", "mpegts", "-af", "loudnorm"}
+	c = tc.CheckCapabilities(context.Background())
+	qtc.Check(c.Problems, qt.DeepEquals, []string{
+		`preset "hevc" needs missing encoder "libx265"`,
+		`preset "hevc" needs missing muxer "mpegts"`,
+		`preset "hevc" needs missing filter "loudnorm"`,
+	})
+	w = get("/readyz")
+	qtc.Check(w.Code, qt.Equals, http.StatusServiceUnavailable)
+	qtc.Check(w.Body.String(), qt.Contains, "libx265")
+
+	tc.FFmpegPath = filepath.Join(t.TempDir(), "missing")
+	c = tc.CheckCapabilities(context.Background())
+	qtc.Check(c.Problems, qt.HasLen, 1)
+	qtc.Check(c.Problems[0], qt.Matches, `running .*missing -version: .*`)
+}
+
+func TestFilterNames(t *testing.T) {
+	qtc := qt.New(t)
+	qtc.Check(filterNames("scale=-2:480"), qt.DeepEquals, []string{"scale"})
+	qtc.Check(
+		filterNames("[0:v]split[a][b];[a]drawtext=text='a, b; c'[x];[b][x]overlay@o"),
+		qt.DeepEquals,
+		[]string{"split", "drawtext", "overlay"})
+}
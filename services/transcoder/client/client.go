@@ -0,0 +1,412 @@
+// Package client talks to the transcoder service over HTTP.
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	g "github.com/anacrolix/generics"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// Returned when the transcoder has neither the output nor a job producing it. This is how failed
+// jobs look once they've ended.
+var ErrNoJob = errors.New("no such job")
+
+// How long to wait before reconnecting after an error.
+var RetryDelay = time.Second
+
+// The progress of a job, as reported by the transcoder.
+type Progress = api.Progress
+
+// A job running on the transcoder.
+type JobStatus = api.JobStatus
+
+// How a request maps to its output name on the transcoder.
+type KeyExplanation = api.KeyExplanation
+
+// Where to find a submitted job.
+type JobRef = api.JobRef
+
+// The parameters of a transcode.
+type Request struct {
+	// An HTTP URL, magnet URI or infohash.
+	Input string
+	// The file within the torrent, for torrent inputs.
+	Path         string
+	Format       string
+	Options      []string
+	InputOptions []string
+	// Transcode only this part of the input. A zero End means the end of the input.
+	Start time.Duration
+	End   time.Duration
+	// How clips start: "accurate" or "keyframe". Empty chooses keyframe seeking if any stream is
+	// copied.
+	Seek string
+	// Extracts audio only, in one of the transcoder's audio formats, from a track given as
+	// "default", an index among the audio tracks, or a language such as "eng".
+	Audio string
+	// For audio: don't copy the input's tags or cover art.
+	StripTags  bool
+	StripCover bool
+	// For audio: tags to set, replacing copied tags. Empty values remove tags.
+	Tags map[string]string
+	// For audio: normalize to this integrated loudness in LUFS, such as -16.
+	Loudnorm float64
+	// "interactive", "prefetch" or "batch". Empty uses the server's default.
+	Priority string
+	// Identifies the requester for fair scheduling, if the server trusts it. Otherwise, or if empty,
+	// the server uses the remote address.
+	Client string
+	// URLs notified when the job finishes. Their hosts must be allowed by the server.
+	Webhooks []string
+}
+
+func (r Request) Query() url.Values {
+	q := url.Values{
+		"i":    {r.Input},
+		"f":    {r.Format},
+		"opt":  r.Options,
+		"iopt": r.InputOptions,
+	}
+	if r.Path != "" {
+		q.Set("path", r.Path)
+	}
+	if r.Start != 0 {
+		q.Set("start", r.Start.String())
+	}
+	if r.End != 0 {
+		q.Set("end", r.End.String())
+	}
+	if r.Seek != "" {
+		q.Set("seek", r.Seek)
+	}
+	if r.Audio != "" {
+		q.Set("audio", r.Audio)
+		if r.StripTags {
+			q.Set("tags", "strip")
+		}
+		if r.StripCover {
+			q.Set("cover", "strip")
+		}
+		for _, k := range sortedKeys(r.Tags) {
+			q.Add("tag", k+"="+r.Tags[k])
+		}
+		if r.Loudnorm != 0 {
+			q.Set("loudnorm", strconv.FormatFloat(r.Loudnorm, 'f', -1, 64))
+		}
+	}
+	if r.Priority != "" {
+		q.Set("priority", r.Priority)
+	}
+	if r.Client != "" {
+		q.Set("client", r.Client)
+	}
+	if len(r.Webhooks) != 0 {
+		q["webhook"] = r.Webhooks
+	}
+	return q
+}
+
+// The name the transcoder stores the output under, if it doesn't have a generation or input
+// normalization configured. Use Client.Explain to find the name otherwise.
+func (r Request) OutputName() string {
+	return api.DefaultOutputName(r.Query())
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type Client struct {
+	// The transcoder's base URL, such as http://localhost:54228.
+	URL string
+	// Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) url(path string, q url.Values) string {
+	return strings.TrimSuffix(c.URL, "/") + path + "?" + q.Encode()
+}
+
+// Where the output is served from. Fetching it starts the transcode if necessary.
+func (c *Client) OutputURL(r Request) string {
+	return c.url("/", r.Query())
+}
+
+func (c *Client) do(ctx context.Context, method, url string, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return c.httpClient().Do(req)
+}
+
+func responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrNoJob
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+	return fmt.Errorf("unexpected status %q: %s", resp.Status, strings.TrimSpace(string(b)))
+}
+
+// Starts a job that runs to completion in the background.
+func (c *Client) Submit(ctx context.Context, r Request) (ref JobRef, err error) {
+	resp, err := c.do(ctx, http.MethodPost, c.url("/jobs", r.Query()), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		err = responseError(resp)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&ref)
+	return
+}
+
+// Lists the running jobs, oldest first.
+func (c *Client) Jobs(ctx context.Context) (jobs []JobStatus, err error) {
+	resp, err := c.do(ctx, http.MethodGet, strings.TrimSuffix(c.URL, "/")+"/jobs", nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&jobs)
+	return
+}
+
+// Returns the transcoder's output name for the request, and how it was derived.
+func (c *Client) Explain(ctx context.Context, r Request) (e KeyExplanation, err error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/explain", r.Query()), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	return
+}
+
+// Returns the job's progress. If since is given, blocks until the progress version exceeds it, the
+// output is ready, or the server's wait period passes.
+func (c *Client) Progress(ctx context.Context, r Request, since g.Option[uint64]) (p Progress, err error) {
+	q := r.Query()
+	if since.Ok {
+		q.Set("since", strconv.FormatUint(since.Value, 10))
+	}
+	resp, err := c.do(ctx, http.MethodGet, c.url("/progress", q), nil)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		return
+	}
+	err = json.NewDecoder(resp.Body).Decode(&p)
+	return
+}
+
+// Calls f with each progress update until the output is ready, reconnecting after errors. Returns
+// ErrNoJob if the job goes away without producing the output.
+func (c *Client) Subscribe(ctx context.Context, r Request, f func(Progress)) error {
+	for {
+		ready, err := c.streamEvents(ctx, r, f)
+		if ready {
+			return nil
+		}
+		if errors.Is(err, ErrNoJob) || ctx.Err() != nil {
+			return err
+		}
+		if err == nil {
+			// The stream ended, either because the job finished or failed. Check which.
+			var p Progress
+			p, err = c.Progress(ctx, r, g.None[uint64]())
+			if err == nil && p.Ready {
+				f(p)
+				return nil
+			}
+			if errors.Is(err, ErrNoJob) {
+				return err
+			}
+		}
+		select {
+		case <-time.After(RetryDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) streamEvents(ctx context.Context, r Request, f func(Progress)) (ready bool, err error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url("/events", r.Query()), http.Header{
+		"Accept": {"text/event-stream"},
+	})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = responseError(resp)
+		return
+	}
+	s := bufio.NewScanner(resp.Body)
+	for s.Scan() {
+		line := s.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var p Progress
+		err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &p)
+		if err != nil {
+			return
+		}
+		f(p)
+		if p.Ready {
+			return true, nil
+		}
+	}
+	return false, s.Err()
+}
+
+// Waits for the output to be ready, starting the job if necessary.
+func (c *Client) Wait(ctx context.Context, r Request) error {
+	if _, err := c.Submit(ctx, r); err != nil {
+		return err
+	}
+	return c.Subscribe(ctx, r, func(Progress) {})
+}
+
+// Requests the output from offset. A negative length reads to the end.
+func (c *Client) get(ctx context.Context, r Request, offset, length int64) (*http.Response, error) {
+	header := make(http.Header)
+	if length >= 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return c.do(ctx, http.MethodGet, c.OutputURL(r), header)
+}
+
+// Fetches the output from offset. A negative length reads to the end, and a zero length returns an
+// empty reader without contacting the server. The transcode is started if necessary, and the
+// response doesn't begin until it completes.
+func (c *Client) Open(ctx context.Context, r Request, offset, length int64) (io.ReadCloser, error) {
+	if length == 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	resp, err := c.get(ctx, r, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent:
+	case resp.StatusCode == http.StatusOK && offset <= 0 && length < 0:
+	default:
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return nil, io.EOF
+		}
+		return nil, responseError(resp)
+	}
+	return resp.Body, nil
+}
+
+// Returns the size of the whole output from a 416 response's Content-Range, such as "bytes */1234".
+func unsatisfiedRangeSize(h http.Header) (int64, bool) {
+	s, ok := strings.CutPrefix(h.Get("Content-Range"), "bytes */")
+	if !ok {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	return size, err == nil
+}
+
+// Downloads the output to the file, resuming if it already has some of it. If the file turns out
+// not to be a prefix of the output, because it's larger, or the server sends the whole output, it's
+// replaced.
+func (c *Client) Download(ctx context.Context, r Request, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	resp, err := c.get(ctx, r, offset, -1)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		offset = 0
+	case http.StatusRequestedRangeNotSatisfiable:
+		if size, ok := unsatisfiedRangeSize(resp.Header); ok && size == offset {
+			// We already have all of it.
+			return f.Close()
+		}
+		// The file is larger than the output, so it isn't a partial download of it. Start again.
+		resp.Body.Close()
+		offset = 0
+		resp, err = c.get(ctx, r, 0, -1)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return responseError(resp)
+		}
+	default:
+		return responseError(resp)
+	}
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(f, resp.Body)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/missinggo/v2/filecache"
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder"
+)
+
+func newTestClient(t *testing.T) (*Client, *filecache.Cache) {
+	fc, err := filecache.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &transcoder.Transcoder{
+		RP:        fc.AsResourceProvider(),
+		OutputDir: t.TempDir(),
+	}
+	tc.Init()
+	srv := httptest.NewServer(tc)
+	t.Cleanup(srv.Close)
+	return &Client{URL: srv.URL}, fc
+}
+
+func TestClient(t *testing.T) {
+	qtc := qt.New(t)
+	c, fc := newTestClient(t)
+	ctx := context.Background()
+	r := Request{
+		Input:        "http://example.com/video.avi?b=2&a=1",
+		Format:       "mp4",
+		Options:      []string{"-c:v", "libx264"},
+		InputOptions: []string{"-ss", "10"},
+		Priority:     "batch",
+	}
+	loc, err := fc.AsResourceProvider().NewInstance(r.OutputName())
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(loc.Put(strings.NewReader("0123456789")), qt.IsNil)
+
+	// The server only reports the cached output if the names agree.
+	ref, err := c.Submit(ctx, r)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(ref.OutputName, qt.Equals, r.OutputName())
+	qtc.Check(c.Wait(ctx, r), qt.IsNil)
+	p, err := c.Progress(ctx, r, g.Some[uint64](0))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(p.Ready, qt.IsTrue)
+
+	rc, err := c.Open(ctx, r, 2, 3)
+	qtc.Assert(err, qt.IsNil)
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "234")
+	rc, err = c.Open(ctx, r, 2, 0)
+	qtc.Assert(err, qt.IsNil)
+	b, err = io.ReadAll(rc)
+	rc.Close()
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(b, qt.HasLen, 0)
+
+	path := filepath.Join(t.TempDir(), "out.mp4")
+	qtc.Assert(os.WriteFile(path, []byte("0123"), 0644), qt.IsNil)
+	qtc.Assert(c.Download(ctx, r, path), qt.IsNil)
+	qtc.Assert(c.Download(ctx, r, path), qt.IsNil)
+	b, err = os.ReadFile(path)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "0123456789")
+	// A file that's longer than the output isn't taken to be complete.
+	qtc.Assert(os.WriteFile(path, []byte("0123456789abc"), 0644), qt.IsNil)
+	qtc.Assert(c.Download(ctx, r, path), qt.IsNil)
+	b, err = os.ReadFile(path)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "0123456789")
+
+	missing := Request{Input: "http://example.com/missing.avi", Format: "mp4"}
+	qtc.Check(c.Subscribe(ctx, missing, func(Progress) {}), qt.Equals, ErrNoJob)
+
+	e, err := c.Explain(ctx, r)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(e.OutputName, qt.Equals, r.OutputName())
+	qtc.Check(e.Cached, qt.IsTrue)
+
+	jobs, err := c.Jobs(ctx)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(jobs, qt.HasLen, 0)
+}
+
+func TestOutputNameWithPath(t *testing.T) {
+	qtc := qt.New(t)
+	c, _ := newTestClient(t)
+	r := Request{
+		Input:  "0123456789abcdef0123456789abcdef01234567",
+		Path:   "dir/file.mkv",
+		Format: "webm",
+	}
+	// Without a torrent client the input isn't allowed, but its name can still be explained.
+	e, err := c.Explain(context.Background(), r)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(e.OutputName, qt.Equals, r.OutputName())
+}
+
+func TestOutputNameNormalization(t *testing.T) {
+	qtc := qt.New(t)
+	c, _ := newTestClient(t)
+	for _, input := range []string{
+		"HTTP://Example.COM:80/a%20b/c%2fd.avi?b=2&a=1#t=10",
+		"https://example.com:443/a+b.avi",
+		"magnet:?xt=urn:btih:0123456789ABCDEF0123456789ABCDEF01234567&dn=name",
+		"0123456789ABCDEF0123456789ABCDEF01234567",
+		"not a url",
+	} {
+		r := Request{Input: input, Format: "mp4"}
+		e, err := c.Explain(context.Background(), r)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(r.OutputName(), qt.Equals, e.OutputName, qt.Commentf("%q", input))
+	}
+	for _, r := range []Request{
+		{Input: "http://example.com/a.avi", Format: "mp4", Start: 1500 * time.Millisecond, End: time.Minute, Seek: "keyframe"},
+		{
+			Input:      "http://example.com/a.mkv",
+			Format:     "opus",
+			Audio:      "eng",
+			StripCover: true,
+			Tags:       map[string]string{"title": "A", "artist": "B"},
+			Loudnorm:   -16.5,
+		},
+	} {
+		e, err := c.Explain(context.Background(), r)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(r.OutputName(), qt.Equals, e.OutputName)
+	}
+}
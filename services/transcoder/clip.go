@@ -0,0 +1,110 @@
+package transcoder
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// Seek modes for clips, given by the seek query parameter.
+const (
+	SeekAccurate = api.SeekAccurate
+	SeekKeyframe = api.SeekKeyframe
+)
+
+// How long to wait for an input server to say whether it supports range requests.
+var rangeCheckTimeout = 10 * time.Second
+
+// A range of the input to transcode. The methods here turn it into ffmpeg options.
+type clip struct {
+	api.Clip
+}
+
+// Whether to seek to the keyframe before the start. Without a seek mode, outputs that copy any
+// stream do, since accurate seeking would only apply to the others.
+func (c clip) keyframeSeek(opts []string) bool {
+	if c.Seek != "" {
+		return c.Seek == SeekKeyframe
+	}
+	for i := 0; i+1 < len(opts); i++ {
+		flag := opts[i]
+		if (flag == "-c" || flag == "-codec" || flag == "-vcodec" || flag == "-acodec" ||
+			strings.HasPrefix(flag, "-c:") || strings.HasPrefix(flag, "-codec:")) &&
+			opts[i+1] == "copy" {
+			return true
+		}
+	}
+	return false
+}
+
+// Input options that seek to the start. Seeking the input, rather than the output, skips decoding
+// everything before it, and lets ffmpeg avoid reading it.
+func (c clip) inputOptions(keyframe bool) (ret []string) {
+	if c.Start == 0 {
+		return
+	}
+	if keyframe {
+		ret = append(ret, "-noaccurate_seek")
+	}
+	return append(ret, "-ss", formatSeconds(c.Start))
+}
+
+// Output options that stop at the end. Output timestamps start from the seek position.
+func (c clip) outputOptions() []string {
+	if c.End == 0 {
+		return nil
+	}
+	return []string{"-t", formatSeconds(c.End - c.Start)}
+}
+
+// The duration of the output, given the input's. Zero if unknown.
+func (c clip) length(inputDuration time.Duration) time.Duration {
+	end := inputDuration
+	if c.End != 0 && (end == 0 || c.End < end) {
+		end = c.End
+	}
+	if end <= c.Start {
+		return 0
+	}
+	return end - c.Start
+}
+
+func formatSeconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', -1, 64)
+}
+
+// Reports whether the HTTP input can be read in ranges, in which case ffmpeg can read just the clip
+// from it rather than the whole input being downloaded first. ffmpeg doesn't share our TLS
+// configuration, and would follow redirects to hosts InputPolicy hasn't seen, so inputs are always
+// downloaded if there's custom TLS configuration or they redirect.
+func (t *Transcoder) rangeReadable(ctx context.Context, input string) bool {
+	if t.CustomInputTLS {
+		return false
+	}
+	u, err := url.Parse(input)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(ctx, rangeCheckTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, input, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	client := *http.DefaultClient
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusPartialContent
+}
@@ -0,0 +1,112 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+func TestClipSeekAndLength(t *testing.T) {
+	qtc := qt.New(t)
+	c := clip{api.Clip{Start: time.Minute, End: 2 * time.Minute}}
+	qtc.Check(c.outputOptions(), qt.DeepEquals, []string{"-t", "60"})
+	qtc.Check(c.keyframeSeek([]string{"-c:v", "libx264"}), qt.IsFalse)
+	qtc.Check(c.keyframeSeek([]string{"-c:v", "libx264", "-c:a", "copy"}), qt.IsTrue)
+	c.Seek = SeekAccurate
+	qtc.Check(c.keyframeSeek([]string{"-c", "copy"}), qt.IsFalse)
+	qtc.Check(c.inputOptions(false), qt.DeepEquals, []string{"-ss", "60"})
+	qtc.Check(c.inputOptions(true), qt.DeepEquals, []string{"-noaccurate_seek", "-ss", "60"})
+	qtc.Check(c.length(0), qt.Equals, time.Minute)
+	qtc.Check(c.length(90*time.Second), qt.Equals, 30*time.Second)
+	qtc.Check(c.length(30*time.Second), qt.Equals, time.Duration(0))
+	qtc.Check(clip{api.Clip{Start: time.Minute}}.length(10*time.Minute), qt.Equals, 9*time.Minute)
+	qtc.Check(clip{}.outputOptions(), qt.IsNil)
+}
+
+func TestClipOutputNames(t *testing.T) {
+	qtc := qt.New(t)
+	q := url.Values{"i": {"http://example.com/a.avi"}, "f": {"mp4"}}
+	whole := jobFromQuery(q)
+	qtc.Check(whole.hashedStrings(nil), qt.DeepEquals, []string{"http://example.com/a.avi"})
+	q.Set("start", "90")
+	clipped := jobFromQuery(q)
+	qtc.Check(clipped.outputName, qt.Not(qt.Equals), whole.outputName)
+	// The same times, written differently.
+	q.Set("start", "1m30s")
+	qtc.Check(jobFromQuery(q).outputName, qt.Equals, clipped.outputName)
+	q.Set("end", "2m")
+	qtc.Check(jobFromQuery(q).outputName, qt.Not(qt.Equals), clipped.outputName)
+
+	tc := newTestTranscoder(t)
+	q.Set("end", "1m")
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+	qtc.Check(w.Code, qt.Equals, http.StatusBadRequest)
+	qtc.Check(w.Body.String(), qt.Equals, "end is not after start\n")
+}
+
+// Clips of inputs served with range support are read by ffmpeg directly, rather than downloaded.
+func TestClipStreamsRangeReadableInput(t *testing.T) {
+	qtc := qt.New(t)
+	var wholeReads atomic.Int32
+	content := bytes.Repeat([]byte("x"), 1<<20)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			wholeReads.Add(1)
+		}
+		http.ServeContent(w, r, "input.avi", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+	redirect := httptest.NewServer(http.RedirectHandler(srv.URL, http.StatusFound))
+	defer redirect.Close()
+	var plain, customTLS Transcoder
+	customTLS.CustomInputTLS = true
+	qtc.Check(plain.rangeReadable(context.Background(), srv.URL), qt.IsTrue)
+	qtc.Check(plain.rangeReadable(context.Background(), "0123456789abcdef0123456789abcdef01234567"), qt.IsFalse)
+	qtc.Check(plain.rangeReadable(context.Background(), redirect.URL), qt.IsFalse)
+	qtc.Check(customTLS.rangeReadable(context.Background(), srv.URL), qt.IsFalse)
+
+	bin := t.TempDir()
+	// Writes its arguments to the output.
+	ffmpeg := filepath.Join(bin, "ffmpeg")
+	qtc.Assert(os.WriteFile(ffmpeg, []byte("#!/bin/sh\nfor arg; do :; done\necho \"$@\" > \"$arg\"\n"), 0755), qt.IsNil)
+	ffprobe := filepath.Join(bin, "ffprobe")
+	qtc.Assert(os.WriteFile(ffprobe, []byte("#!/bin/sh\necho 600\n"), 0755), qt.IsNil)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.FFmpegPath = ffmpeg
+		tc.FFprobePath = ffprobe
+	})
+	input := srv.URL + "/input.avi"
+	name, err := tc.Run(context.Background(), url.Values{
+		"i":     {input},
+		"f":     {"mp4"},
+		"opt":   {"-c", "copy"},
+		"start": {"60"},
+		"end":   {"90"},
+	}, func(Progress) {})
+	qtc.Assert(err, qt.IsNil)
+	loc, err := tc.RP.NewInstance(name)
+	qtc.Assert(err, qt.IsNil)
+	rc, err := loc.Get()
+	qtc.Assert(err, qt.IsNil)
+	defer rc.Close()
+	b, err := io.ReadAll(rc)
+	qtc.Assert(err, qt.IsNil)
+	args := string(b)
+	qtc.Check(args, qt.Contains, "-noaccurate_seek -ss 60 -i "+input+" -t 30 -c copy")
+	qtc.Check(strings.Contains(args, ".input"), qt.IsFalse)
+	qtc.Check(wholeReads.Load(), qt.Equals, int32(0))
+}
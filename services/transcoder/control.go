@@ -0,0 +1,163 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+// Event websockets that negotiate this subprotocol accept ControlRequests, and all messages sent on
+// them are ControlMessages. Otherwise, bare Progress values are sent and incoming messages are
+// ignored.
+const ControlSubprotocol = "transcoder-control"
+
+// The cause of jobs cancelled by a control request.
+var errCancelledByClient = errors.New("cancelled by client")
+
+var errNoSuchJob = errors.New("no such job")
+
+// Control connections may only cancel jobs nobody else wants.
+var (
+	errJobDetached = errors.New("job is detached")
+	errJobWatched  = errors.New("job has waiters from other clients")
+)
+
+// Sent by the client on a control websocket.
+type ControlRequest struct {
+	// Echoed in the reply.
+	ID string `json:",omitempty"`
+	// "cancel", "priority", "snapshot" or "subscribe". Jobs can only be cancelled when they aren't
+	// detached and every request waiting on them is from the same client as the connection.
+	Type string
+	// The job the request applies to. Defaults to the one the websocket was opened for.
+	OutputName string `json:",omitempty"`
+	// The priority to raise the job to, for "priority" requests.
+	Priority Priority `json:",omitempty"`
+}
+
+// Sent by the transcoder on a control websocket.
+type ControlMessage struct {
+	// "progress", "ack" or "error". Snapshot requests are replied to with "progress".
+	Type string
+	// The ID of the request being replied to, if any.
+	ID         string    `json:",omitempty"`
+	OutputName string    `json:",omitempty"`
+	Progress   *Progress `json:",omitempty"`
+	Error      string    `json:",omitempty"`
+}
+
+// Sends progress for the output and any others subscribed to, and handles control requests from
+// the client until the connection is closed.
+func (t *Transcoder) serveControl(ctx context.Context, conn *websocket.Conn, outputName, client string) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	send := func(m ControlMessage) bool {
+		err := wsjson.Write(ctx, conn, m)
+		return err == nil
+	}
+	var (
+		mu         sync.Mutex
+		subscribed = make(map[string]bool)
+	)
+	subscribe := func(name string) error {
+		loc, err := t.RP.NewInstance(name)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if subscribed[name] {
+			return nil
+		}
+		subscribed[name] = true
+		go func() {
+			t.watchProgress(ctx, name, loc, func(p Progress) bool {
+				return send(ControlMessage{Type: "progress", OutputName: name, Progress: &p})
+			})
+			mu.Lock()
+			delete(subscribed, name)
+			mu.Unlock()
+		}()
+		return nil
+	}
+	if err := subscribe(outputName); err != nil {
+		send(ControlMessage{Type: "error", OutputName: outputName, Error: err.Error()})
+		return
+	}
+	for {
+		_, b, err := conn.Read(ctx)
+		if err != nil {
+			return
+		}
+		var req ControlRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			send(ControlMessage{Type: "error", Error: fmt.Sprintf("decoding request: %v", err)})
+			continue
+		}
+		if req.OutputName == "" {
+			req.OutputName = outputName
+		}
+		if !send(t.handleControl(req, client, subscribe)) {
+			return
+		}
+	}
+}
+
+func (t *Transcoder) handleControl(req ControlRequest, client string, subscribe func(string) error) ControlMessage {
+	reply := ControlMessage{Type: "ack", ID: req.ID, OutputName: req.OutputName}
+	err := func() error {
+		switch req.Type {
+		case "cancel":
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			rj := t.jobs[req.OutputName]
+			switch {
+			case rj == nil:
+				return errNoSuchJob
+			case rj.detached:
+				return errJobDetached
+			case rj.waiters != rj.clientWaiters[client]:
+				return errJobWatched
+			}
+			rj.cancel(errCancelledByClient)
+		case "priority":
+			t.mu.Lock()
+			rj := t.jobs[req.OutputName]
+			t.mu.Unlock()
+			if rj == nil {
+				return errNoSuchJob
+			}
+			p := parsePriority(string(req.Priority), "")
+			if p == "" {
+				return fmt.Errorf("unknown priority %q", req.Priority)
+			}
+			t.sched.bump(req.OutputName, p)
+		case "snapshot":
+			loc, err := t.RP.NewInstance(req.OutputName)
+			if err != nil {
+				return err
+			}
+			pOpt := t.getProgress(loc, req.OutputName)
+			if !pOpt.Ok {
+				return errNoSuchJob
+			}
+			reply.Type = "progress"
+			reply.Progress = &pOpt.Value
+		case "subscribe":
+			return subscribe(req.OutputName)
+		default:
+			return fmt.Errorf("unknown request type %q", req.Type)
+		}
+		return nil
+	}()
+	if err != nil {
+		reply.Type = "error"
+		reply.Error = err.Error()
+	}
+	return reply
+}
@@ -0,0 +1,123 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"nhooyr.io/websocket"
+	"nhooyr.io/websocket/wsjson"
+)
+
+func TestControlWebsocket(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.DisconnectPolicy = ContinueUnwatched
+	})
+	srv := httptest.NewServer(tc)
+	defer srv.Close()
+	j := hangingJob(t)
+	rj := tc.startJob(j, true)
+	for {
+		tc.mu.Lock()
+		op := tc.operations[j.outputName]
+		tc.mu.Unlock()
+		if op != nil {
+			op.mu.Lock()
+			downloading := op.Progress.Downloading
+			op.mu.Unlock()
+			if downloading {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	q := url.Values{"i": {j.input}, "f": {j.format}}
+	conn, _, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/events?"+q.Encode(), &websocket.DialOptions{
+		Subprotocols: []string{ControlSubprotocol},
+	})
+	qtc.Assert(err, qt.IsNil)
+	defer conn.Close(websocket.StatusNormalClosure, "")
+	qtc.Assert(conn.Subprotocol(), qt.Equals, ControlSubprotocol)
+
+	var m ControlMessage
+	qtc.Assert(wsjson.Read(ctx, conn, &m), qt.IsNil)
+	qtc.Check(m.Type, qt.Equals, "progress")
+	qtc.Check(m.OutputName, qt.Equals, j.outputName)
+	qtc.Check(m.Progress, qt.IsNotNil)
+
+	request := func(req ControlRequest) ControlMessage {
+		qtc.Assert(wsjson.Write(ctx, conn, req), qt.IsNil)
+		for {
+			var m ControlMessage
+			qtc.Assert(wsjson.Read(ctx, conn, &m), qt.IsNil)
+			if m.ID == req.ID {
+				return m
+			}
+		}
+	}
+	m = request(ControlRequest{ID: "1", Type: "snapshot"})
+	qtc.Check(m.Type, qt.Equals, "progress")
+	qtc.Check(m.Progress.Downloading, qt.IsTrue)
+	m = request(ControlRequest{ID: "2", Type: "priority", Priority: "urgent"})
+	qtc.Check(m.Error, qt.Equals, `unknown priority "urgent"`)
+	m = request(ControlRequest{ID: "3", Type: "priority", Priority: PriorityInteractive})
+	qtc.Check(m.Type, qt.Equals, "ack")
+	m = request(ControlRequest{ID: "4", Type: "subscribe", OutputName: "missing.mp4"})
+	qtc.Check(m.Type, qt.Equals, "ack")
+	m = request(ControlRequest{ID: "5", Type: "cancel", OutputName: "missing.mp4"})
+	qtc.Check(m.Error, qt.Equals, errNoSuchJob.Error())
+	m = request(ControlRequest{ID: "6", Type: "rewind"})
+	qtc.Check(m.Error, qt.Equals, `unknown request type "rewind"`)
+	// Jobs others want can't be cancelled.
+	m = request(ControlRequest{ID: "7", Type: "cancel"})
+	qtc.Check(m.Error, qt.Equals, errJobDetached.Error())
+	tc.mu.Lock()
+	rj.detached = false
+	tc.mu.Unlock()
+	otherCtx, otherLeft := context.WithCancel(ctx)
+	go tc.waitJob(otherCtx, rj, "203.0.113.1")
+	waitForWaiters := func(n int) {
+		for {
+			tc.mu.Lock()
+			waiters := rj.waiters
+			tc.mu.Unlock()
+			if waiters == n {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitForWaiters(1)
+	m = request(ControlRequest{ID: "8", Type: "cancel"})
+	qtc.Check(m.Error, qt.Equals, errJobWatched.Error())
+	otherLeft()
+	waitForWaiters(0)
+
+	// The connection's own client can cancel the job it's waiting on.
+	got := make(chan int)
+	go func() {
+		resp, err := http.Get(srv.URL + "/?" + q.Encode())
+		if err != nil {
+			got <- 0
+			return
+		}
+		resp.Body.Close()
+		got <- resp.StatusCode
+	}()
+	waitForWaiters(1)
+	m = request(ControlRequest{ID: "9", Type: "cancel"})
+	qtc.Check(m.Type, qt.Equals, "ack")
+	<-rj.done
+	qtc.Check(errors.Is(rj.err, errCancelledByClient), qt.IsTrue, qt.Commentf("%v", rj.err))
+	qtc.Check(<-got, qt.Equals, http.StatusInternalServerError)
+}
@@ -0,0 +1,58 @@
+package transcoder
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Response headers that cross-origin scripts may read.
+var corsExposedHeaders = strings.Join([]string{
+	"Accept-Ranges",
+	"Content-Disposition",
+	"Content-Length",
+	"Content-Range",
+	"ETag",
+	"Location",
+	"Retry-After",
+}, ", ")
+
+// Whether the origin matches one of AllowedOrigins.
+func (t *Transcoder) originAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, pattern := range t.AllowedOrigins {
+		if pattern == "*" {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds CORS headers for allowed origins. Returns true if the request was a preflight, which has been
+// responded to.
+func (t *Transcoder) handleCORS(w http.ResponseWriter, r *http.Request) (preflight bool) {
+	origin := r.Header.Get("Origin")
+	w.Header().Add("Vary", "Origin")
+	allowed := t.originAllowed(origin)
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", corsExposedHeaders)
+	}
+	if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	if allowed {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, OPTIONS")
+		if h := r.Header.Get("Access-Control-Request-Headers"); h != "" {
+			w.Header().Set("Access-Control-Allow-Headers", h)
+		}
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
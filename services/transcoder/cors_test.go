@@ -0,0 +1,62 @@
+package transcoder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCORS(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.AllowedOrigins = []string{"https://*.example.com"}
+	})
+
+	r := httptest.NewRequest(http.MethodOptions, "/prefetch", nil)
+	r.Header.Set("Origin", "https://player.example.com")
+	r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	r.Header.Set("Access-Control-Request-Headers", "content-type")
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, r)
+	qtc.Check(w.Code, qt.Equals, http.StatusNoContent)
+	qtc.Check(w.Header().Get("Access-Control-Allow-Origin"), qt.Equals, "https://player.example.com")
+	qtc.Check(w.Header().Get("Access-Control-Allow-Headers"), qt.Equals, "content-type")
+	qtc.Check(w.Header().Get("Access-Control-Allow-Methods"), qt.Contains, "POST")
+
+	r = httptest.NewRequest(http.MethodGet, "/history", nil)
+	r.Header.Set("Origin", "https://evil.com")
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, r)
+	qtc.Check(w.Header().Get("Access-Control-Allow-Origin"), qt.Equals, "")
+	qtc.Check(w.Header().Get("Vary"), qt.Equals, "Origin")
+
+	// Event websockets from other origins are refused.
+	r = httptest.NewRequest(http.MethodGet, "/events?"+url.Values{"i": {"x"}, "f": {"mp4"}}.Encode(), nil)
+	r.Header.Set("Origin", "https://evil.com")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, r)
+	qtc.Check(w.Code, qt.Equals, http.StatusForbidden)
+}
+
+func TestJobFilename(t *testing.T) {
+	qtc := qt.New(t)
+	filename := func(q url.Values) string {
+		return jobFromQuery(q).filename()
+	}
+	qtc.Check(filename(url.Values{"i": {"http://example.com/shows/Episode%201.mkv?x=1"}, "f": {"mp4"}}),
+		qt.Equals, "Episode 1.mp4")
+	qtc.Check(filename(url.Values{
+		"i":    {"magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"},
+		"path": {"Show/S01E02.avi"},
+		"f":    {"webm"},
+	}), qt.Equals, "S01E02.webm")
+	j := jobFromQuery(url.Values{"i": {"0123456789abcdef0123456789abcdef01234567"}, "f": {"mp4"}})
+	qtc.Check(j.filename(), qt.Equals, j.outputName)
+}
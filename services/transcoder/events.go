@@ -0,0 +1,112 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	g "github.com/anacrolix/generics"
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/resource"
+)
+
+// The minimum time between progress updates sent to a client.
+var progressInterval = 100 * time.Millisecond
+
+// How long progress long-polls block for by default, and at most.
+const (
+	defaultProgressWait = 30 * time.Second
+	maxProgressWait     = 5 * time.Minute
+)
+
+func acceptsEventStream(r *http.Request) bool {
+	for _, s := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, _ := mime.ParseMediaType(s); mt == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// Streams progress as Server-Sent Events, for clients that can't use websockets. Each event's id is
+// the progress version.
+func (t *Transcoder) serveEventStream(
+	w http.ResponseWriter,
+	r *http.Request,
+	outputName string,
+	outputLoc resource.Instance,
+) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	if !t.getProgress(outputLoc, outputName).Ok {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	t.watchProgress(r.Context(), outputName, outputLoc, func(p Progress) bool {
+		b, err := json.Marshal(p)
+		if err != nil {
+			log.Printf("error encoding transcoder event: %v", err)
+			return false
+		}
+		_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", p.Version, b)
+		if err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	})
+}
+
+// Responds with the progress as JSON. If the since query parameter is given, blocks until the
+// version exceeds it, the output is ready, or the wait duration passes.
+func (t *Transcoder) serveProgress(
+	w http.ResponseWriter,
+	r *http.Request,
+	outputName string,
+	outputLoc resource.Instance,
+) {
+	q := r.URL.Query()
+	var since g.Option[uint64]
+	if s := q.Get("since"); s != "" {
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad since: %v", err), http.StatusBadRequest)
+			return
+		}
+		since.Set(v)
+	}
+	wait := defaultProgressWait
+	if s := q.Get("wait"); s != "" {
+		var err error
+		wait, err = time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("bad wait: %v", err), http.StatusBadRequest)
+			return
+		}
+		if wait > maxProgressWait {
+			wait = maxProgressWait
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	var last g.Option[Progress]
+	t.watchProgress(ctx, outputName, outputLoc, func(p Progress) bool {
+		last.Set(p)
+		return since.Ok && !p.Ready && p.Version <= since.Value
+	})
+	if !last.Ok {
+		http.Error(w, "no such job", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(last.Value)
+}
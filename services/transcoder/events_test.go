@@ -0,0 +1,85 @@
+package transcoder
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestProgressAlternatives(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	srv := httptest.NewServer(tc)
+	defer srv.Close()
+	q := url.Values{"i": {"http://example.com/input.avi"}, "f": {"mp4"}}
+	j := jobFromQuery(q)
+
+	resp, err := http.Get(srv.URL + "/progress?" + q.Encode())
+	qtc.Assert(err, qt.IsNil)
+	resp.Body.Close()
+	qtc.Check(resp.StatusCode, qt.Equals, http.StatusNotFound)
+
+	op := tc.newOperation()
+	op.updateProgress(func(p *Progress) {
+		p.Downloading = true
+	})
+	tc.mu.Lock()
+	tc.operations[j.outputName] = op
+	tc.mu.Unlock()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/events?"+q.Encode(), nil)
+	qtc.Assert(err, qt.IsNil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(req)
+	qtc.Assert(err, qt.IsNil)
+	defer resp.Body.Close()
+	qtc.Assert(resp.Header.Get("Content-Type"), qt.Equals, "text/event-stream")
+	events := bufio.NewReader(resp.Body)
+	readEvent := func() (id uint64, p Progress) {
+		for {
+			line, err := events.ReadString('\n')
+			qtc.Assert(err, qt.IsNil)
+			line = strings.TrimSuffix(line, "\n")
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id, err = strconv.ParseUint(line[4:], 10, 64)
+				qtc.Assert(err, qt.IsNil)
+			case strings.HasPrefix(line, "data: "):
+				qtc.Assert(json.Unmarshal([]byte(line[6:]), &p), qt.IsNil)
+			case line == "":
+				return
+			}
+		}
+	}
+	id, p := readEvent()
+	qtc.Check(p.Downloading, qt.IsTrue)
+	qtc.Check(id, qt.Equals, p.Version)
+
+	polled := make(chan Progress)
+	pollQuery := url.Values{"since": {strconv.FormatUint(p.Version, 10)}, "i": q["i"], "f": q["f"]}
+	go func() {
+		resp, err := http.Get(srv.URL + "/progress?" + pollQuery.Encode())
+		if err != nil {
+			panic(err)
+		}
+		defer resp.Body.Close()
+		var p Progress
+		json.NewDecoder(resp.Body).Decode(&p)
+		polled <- p
+	}()
+	op.updateProgress(func(p *Progress) {
+		p.DownloadProgress = 0.5
+	})
+	_, p = readEvent()
+	qtc.Check(p.DownloadProgress, qt.Equals, 0.5)
+	pp := <-polled
+	qtc.Check(pp.DownloadProgress, qt.Equals, 0.5)
+	qtc.Check(pp.Version, qt.Equals, p.Version)
+}
@@ -0,0 +1,189 @@
+package transcoder
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// Entries of the history kept in memory for queries. Older entries stay in the file.
+var maxHistoryEntries = 10000
+
+// An append-only record of finished jobs, stored as JSON lines. The file is read when opened, and
+// queries are answered from the most recent entries kept in memory.
+type History struct {
+	mu      sync.Mutex
+	path    string
+	entries []JobResult
+}
+
+func OpenHistory(path string) (*History, error) {
+	os.MkdirAll(filepath.Dir(path), 0750)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := &History{path: path}
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var res JobResult
+		if err := json.Unmarshal(s.Bytes(), &res); err != nil {
+			// A partially written line from a crash shouldn't hide the rest of the history.
+			log.Levelf(log.Warning, "error decoding history entry: %v", err)
+			continue
+		}
+		h.add(res)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if fi, err := f.Stat(); err == nil && fi.Size() != 0 {
+		// End a torn last line, so it doesn't take the next entry with it.
+		var b [1]byte
+		if _, err := f.ReadAt(b[:], fi.Size()-1); err == nil && b[0] != '\n' {
+			f.Write([]byte{'\n'})
+		}
+	}
+	return h, nil
+}
+
+func (h *History) add(res JobResult) {
+	h.entries = append(h.entries, res)
+	if len(h.entries) > maxHistoryEntries {
+		h.entries = append(h.entries[:0], h.entries[len(h.entries)-maxHistoryEntries:]...)
+	}
+}
+
+// Records a job. Credentials in its input, and in errors that quote it, are redacted first.
+func (h *History) Append(res JobResult) error {
+	res = res.redacted()
+	b, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.add(res)
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Selects jobs from the history. Zero values match everything.
+type HistoryFilter struct {
+	State JobState
+	// Matches inputs containing this string.
+	Input      string
+	Format     string
+	OutputName string
+	// Matches jobs that finished in this window.
+	Since, Until time.Time
+	// Maximum number of results, most recent first.
+	Limit int
+}
+
+func (f HistoryFilter) matches(res JobResult) bool {
+	if f.State != "" && res.State != f.State {
+		return false
+	}
+	if f.Input != "" && !strings.Contains(res.Input, f.Input) {
+		return false
+	}
+	if f.Format != "" && res.Format != f.Format {
+		return false
+	}
+	if f.OutputName != "" && res.OutputName != f.OutputName {
+		return false
+	}
+	if !f.Since.IsZero() && res.Finished.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !res.Finished.Before(f.Until) {
+		return false
+	}
+	return true
+}
+
+func historyFilterFromQuery(q url.Values) (f HistoryFilter, err error) {
+	f.State = JobState(q.Get("state"))
+	f.Input = q.Get("input")
+	f.Format = q.Get("f")
+	f.OutputName = q.Get("output")
+	for _, t := range []struct {
+		key string
+		to  *time.Time
+	}{
+		{"since", &f.Since},
+		{"until", &f.Until},
+	} {
+		if s := q.Get(t.key); s != "" {
+			*t.to, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				err = fmt.Errorf("parsing %s: %w", t.key, err)
+				return
+			}
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		f.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			err = fmt.Errorf("parsing limit: %w", err)
+			return
+		}
+	}
+	return
+}
+
+// Returns matching jobs, most recent first.
+func (h *History) Query(filter HistoryFilter) (ret []JobResult, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(ret) == filter.Limit {
+			break
+		}
+		if filter.matches(h.entries[i]) {
+			ret = append(ret, h.entries[i])
+		}
+	}
+	return
+}
+
+func (t *Transcoder) serveHistory(w http.ResponseWriter, r *http.Request) {
+	if t.History == nil {
+		http.Error(w, "history not enabled", http.StatusNotFound)
+		return
+	}
+	filter, err := historyFilterFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	jobs, err := t.History.Query(filter)
+	if err != nil {
+		log.Printf("error querying history: %v", err)
+		http.Error(w, "error querying history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jobs)
+}
@@ -0,0 +1,208 @@
+package transcoder
+
+import (
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
+
+// The parameters of a transcode, as given in a request.
+type job struct {
+	outputName string
+	input      string
+	// The file within the torrent, when the input is a magnet URI or infohash.
+	inputPath string
+	// What the input and path are hashed as. See InputNormalization.
+	identity     string
+	identityPath string
+	format       string
+	opts         []string
+	iopts        []string
+	clip         clip
+	// Set for audio-only outputs.
+	audio *AudioExtraction
+	// Why the request's parameters are invalid, if they are.
+	invalid error
+	// Scheduling parameters. These don't affect the output.
+	priority Priority
+	client   string
+	// Notified when the job finishes, from the webhook query parameter.
+	webhooks []string
+}
+
+func jobFromQuery(q url.Values) (j job) {
+	spec, invalid := api.ParseJob(q)
+	j.input = spec.Input
+	j.inputPath = spec.InputPath
+	j.format = spec.Format
+	j.opts = spec.Options
+	j.iopts = spec.InputOptions
+	j.clip = clip{spec.Clip}
+	j.audio = spec.Audio
+	j.invalid = invalid
+	j.priority = parsePriority(q.Get("priority"), PriorityInteractive)
+	j.webhooks = q["webhook"]
+	j.identity, j.identityPath = InputNormalization{}.Identity(j.input, j.inputPath)
+	j.setOutputName(nil)
+	return
+}
+
+// The name a transcoder with no Generation or InputNormalization configured stores the output of a
+// request under. Transcoder.Explain gives the name in other configurations.
+func OutputName(q url.Values) string {
+	return api.DefaultOutputName(q)
+}
+
+// The strings hashed to make the output name. salt is appended so that outputs made with different
+// settings get different names.
+func (j job) hashedStrings(salt []string) []string {
+	return api.Job{
+		Options:      j.opts,
+		InputOptions: j.iopts,
+		Clip:         j.clip.Clip,
+		Audio:        j.audio,
+	}.HashedStrings(j.identity, j.identityPath, salt)
+}
+
+func (j *job) setOutputName(salt []string) {
+	j.outputName = api.OutputName(j.hashedStrings(salt), j.format)
+}
+
+// A friendly name for the output, from the input's file name with the extension replaced by the
+// format. Falls back to the output name when the input has no useful name.
+func (j job) filename() string {
+	name := path.Base(j.inputPath)
+	if j.inputPath == "" {
+		if torrents.IsRef(j.input) {
+			return j.outputName
+		}
+		u, err := url.Parse(j.input)
+		if err != nil {
+			return j.outputName
+		}
+		name = path.Base(u.Path)
+	}
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "" || name == "." || name == "/" {
+		return j.outputName
+	}
+	return name + "." + j.format
+}
+
+type JobState string
+
+const (
+	JobCompleted JobState = "completed"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// When a stage of a job started and finished. Stages are "queue", "download", "probe", "analyze"
+// (only for audio outputs with loudness normalization), "convert" and "store".
+type StageTimes struct {
+	Started  time.Time
+	Finished time.Time
+}
+
+// Summarizes a finished job.
+type JobResult struct {
+	OutputName   string
+	Input        string
+	InputPath    string `json:",omitempty"`
+	Format       string
+	Options      []string
+	InputOptions []string
+	// The clip transcoded, if not the whole input.
+	Start    time.Duration    `json:",omitempty"`
+	End      time.Duration    `json:",omitempty"`
+	Audio    *AudioExtraction `json:",omitempty"`
+	Priority Priority
+	Client   string `json:",omitempty"`
+	State    JobState
+	Error    string `json:",omitempty"`
+	// The size of the output in bytes.
+	Size          int64
+	InputDuration time.Duration
+	// The length of the clip, or InputDuration for whole inputs.
+	OutputDuration time.Duration
+	Started        time.Time
+	Finished       time.Time
+	Stages         map[string]StageTimes `json:",omitempty"`
+	// The resource limits applied to ffmpeg.
+	Limits ResourceLimits
+}
+
+// Returns the result with credentials in its input, and in errors that quote it, redacted.
+func (res JobResult) redacted() JobResult {
+	res.Error = redactInput(res.Input, res.Error)
+	res.Input = redactInput(res.Input, res.Input)
+	return res
+}
+
+func (t *Transcoder) jobResult(j job, op *operation, err error, cancelled bool) JobResult {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	res := JobResult{
+		OutputName:     j.outputName,
+		Input:          j.input,
+		InputPath:      j.inputPath,
+		Format:         j.format,
+		Options:        j.opts,
+		InputOptions:   j.iopts,
+		Start:          j.clip.Start,
+		End:            j.clip.End,
+		Audio:          j.audio,
+		Priority:       j.priority,
+		Client:         j.client,
+		State:          JobCompleted,
+		Size:           op.outputSize,
+		InputDuration:  op.Progress.InputDuration,
+		OutputDuration: op.Progress.OutputDuration,
+		Started:        op.started,
+		Finished:       time.Now(),
+		Stages:         make(map[string]StageTimes, len(op.stages)),
+		Limits:         op.limits,
+	}
+	for k, v := range op.stages {
+		res.Stages[k] = v
+	}
+	if err != nil {
+		res.State = JobFailed
+		if cancelled {
+			res.State = JobCancelled
+		}
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// Records a finished job, and reports it to webhooks.
+func (t *Transcoder) jobFinished(res JobResult) {
+	t.metrics.jobFinished(res)
+	t.recordJobDuration(res)
+	t.recordFailure(res)
+	if t.History != nil {
+		if err := t.History.Append(res); err != nil {
+			log.Printf("error recording %q in history: %v", res.OutputName, err)
+		}
+	}
+	t.notifyWebhooks(res)
+}
+
+// The most recently started stage. For failed jobs, this is where the failure occurred.
+func (res JobResult) LastStage() (ret string) {
+	var latest time.Time
+	for name, st := range res.Stages {
+		if !st.Started.Before(latest) {
+			latest = st.Started
+			ret = name
+		}
+	}
+	return
+}
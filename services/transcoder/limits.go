@@ -0,0 +1,117 @@
+package transcoder
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Constrains the ffmpeg process for each job. Limits that rely on a tool that isn't installed are
+// skipped, and JobResult reports which were applied.
+type ResourceLimits struct {
+	// Passed to ffmpeg as -threads. Zero lets ffmpeg decide.
+	Threads int `json:",omitempty"`
+	// Niceness adjustment passed to nice. Zero uses nice's default of 10.
+	Nice int `json:",omitempty"`
+	// ionice scheduling class: 1 for realtime, 2 for best-effort, 3 for idle. Zero leaves it
+	// unchanged.
+	IOClass int `json:",omitempty"`
+	// ionice priority within the class, 0 (highest) to 7.
+	IOPriority int `json:",omitempty"`
+	// Address space limit in bytes, applied with prlimit.
+	MaxMemory int64 `json:",omitempty"`
+	// CPU time limit, applied with prlimit.
+	MaxCPUTime time.Duration `json:",omitempty"`
+	// A cgroup v2 directory, such as /sys/fs/cgroup/transcoder.slice, in which a cgroup is created
+	// for each job. The cpu and memory controllers must be enabled in its cgroup.subtree_control.
+	Cgroup string `json:",omitempty"`
+	// CPUs worth of time each job's cgroup may use.
+	CgroupCPUs float64 `json:",omitempty"`
+	// Memory limit in bytes for each job's cgroup.
+	CgroupMemory int64 `json:",omitempty"`
+}
+
+var lookPath = exec.LookPath
+
+// Returns the commands to prefix ffmpeg with to apply the limits, and the limits that will be
+// applied by them.
+func (l ResourceLimits) wrapperArgs() (ret []string, applied ResourceLimits) {
+	if _, err := lookPath("nice"); err == nil {
+		// Windows does not have nice (things lol).
+		ret = append(ret, "nice")
+		if l.Nice != 0 {
+			ret = append(ret, "-n", strconv.Itoa(l.Nice))
+			applied.Nice = l.Nice
+		} else {
+			applied.Nice = 10
+		}
+	}
+	if l.IOClass != 0 {
+		if _, err := lookPath("ionice"); err == nil {
+			ret = append(ret, "ionice", "-c", strconv.Itoa(l.IOClass))
+			if l.IOClass != 3 {
+				ret = append(ret, "-n", strconv.Itoa(l.IOPriority))
+				applied.IOPriority = l.IOPriority
+			}
+			applied.IOClass = l.IOClass
+		}
+	}
+	if l.MaxMemory != 0 || l.MaxCPUTime != 0 {
+		if _, err := lookPath("prlimit"); err == nil {
+			ret = append(ret, "prlimit")
+			if l.MaxMemory != 0 {
+				ret = append(ret, "--as="+strconv.FormatInt(l.MaxMemory, 10))
+				applied.MaxMemory = l.MaxMemory
+			}
+			if l.MaxCPUTime != 0 {
+				secs := int64((l.MaxCPUTime + time.Second - 1) / time.Second)
+				ret = append(ret, "--cpu="+strconv.FormatInt(secs, 10))
+				applied.MaxCPUTime = time.Duration(secs) * time.Second
+			}
+			ret = append(ret, "--")
+		}
+	}
+	applied.Threads = l.Threads
+	return
+}
+
+// Creates a cgroup for a job with the configured caps. The returned directory is empty if no
+// cgroup is configured.
+func (l ResourceLimits) createCgroup(name string) (dir string, err error) {
+	if l.Cgroup == "" {
+		return
+	}
+	dir = filepath.Join(l.Cgroup, name)
+	err = os.Mkdir(dir, 0750)
+	if err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	write := func(file, value string) {
+		if err == nil {
+			err = os.WriteFile(filepath.Join(dir, file), []byte(value), 0640)
+			if err != nil {
+				err = fmt.Errorf("writing %s: %w", file, err)
+			}
+		}
+	}
+	err = nil
+	if l.CgroupCPUs != 0 {
+		const period = 100000
+		write("cpu.max", fmt.Sprintf("%d %d", int64(l.CgroupCPUs*period), period))
+	}
+	if l.CgroupMemory != 0 {
+		write("memory.max", strconv.FormatInt(l.CgroupMemory, 10))
+	}
+	if err != nil {
+		os.Remove(dir)
+		return "", err
+	}
+	return
+}
+
+func addToCgroup(dir string, pid int) error {
+	return os.WriteFile(filepath.Join(dir, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0640)
+}
@@ -0,0 +1,63 @@
+package transcoder
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestLimitsWrapperArgs(t *testing.T) {
+	qtc := qt.New(t)
+	defer func() { lookPath = exec.LookPath }()
+	lookPath = func(file string) (string, error) {
+		if file == "ionice" {
+			return "", errors.New("not found")
+		}
+		return "/usr/bin/" + file, nil
+	}
+	args, applied := ResourceLimits{
+		Threads:    2,
+		Nice:       15,
+		IOClass:    3,
+		MaxMemory:  1 << 30,
+		MaxCPUTime: 90*time.Minute + time.Millisecond,
+	}.wrapperArgs()
+	qtc.Check(args, qt.DeepEquals, []string{
+		"nice", "-n", "15",
+		"prlimit", "--as=1073741824", "--cpu=5401", "--",
+	})
+	qtc.Check(applied, qt.DeepEquals, ResourceLimits{
+		Threads:    2,
+		Nice:       15,
+		MaxMemory:  1 << 30,
+		MaxCPUTime: 5401 * time.Second,
+	})
+	args, _ = ffmpegArgs("ffmpeg", "in", "localhost:1", "out.mp4", "/tmp/out.mp4", []string{"-threads", "4"}, nil, ResourceLimits{Threads: 2})
+	qtc.Check(args[:9], qt.DeepEquals, []string{"nice", "ffmpeg", "-hide_banner", "-i", "in", "-threads", "2", "-threads", "4"})
+}
+
+func TestCreateCgroup(t *testing.T) {
+	qtc := qt.New(t)
+	parent := t.TempDir()
+	dir, err := ResourceLimits{
+		Cgroup:       parent,
+		CgroupCPUs:   1.5,
+		CgroupMemory: 1 << 30,
+	}.createCgroup("out.mp4")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(dir, qt.Equals, filepath.Join(parent, "out.mp4"))
+	b, err := os.ReadFile(filepath.Join(dir, "cpu.max"))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "150000 100000")
+	b, err = os.ReadFile(filepath.Join(dir, "memory.max"))
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(string(b), qt.Equals, "1073741824")
+	dir, err = ResourceLimits{}.createCgroup("out.mp4")
+	qtc.Check(err, qt.IsNil)
+	qtc.Check(dir, qt.Equals, "")
+}
@@ -0,0 +1,233 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// The most log served in a response. Longer logs are served from the end.
+var maxLogSize int64 = 1 << 20
+
+// How often the log of a running job is checked for more output.
+var logFollowInterval = 250 * time.Millisecond
+
+// Partial lines longer than this are written out without waiting for the rest.
+const maxLogLine = 64 << 10
+
+var errLogLimit = errors.New("log limit reached")
+
+// Marks where a log is cut. It counts towards maxLogSize.
+const logTruncatedNote = "[log truncated]\n"
+
+var urlCredentialsRegexp = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// Returns a function that removes credentials from log lines: user info from any URL, and the
+// query of the input URL, which is often a signature or token.
+func logRedactor(input string) func([]byte) []byte {
+	var query []byte
+	if u, err := url.Parse(input); err == nil && u.RawQuery != "" {
+		query = []byte("?" + u.RawQuery)
+	}
+	return func(b []byte) []byte {
+		b = urlCredentialsRegexp.ReplaceAll(b, []byte("${1}REDACTED@"))
+		if query != nil {
+			b = bytes.ReplaceAll(b, query, []byte("?REDACTED"))
+		}
+		return b
+	}
+}
+
+// Redacts s as logRedactor does. For the input itself, and anything else that quotes it, when
+// they're served, logged or stored.
+func redactInput(input, s string) string {
+	return string(logRedactor(input)([]byte(s)))
+}
+
+// Redacts ffmpeg arguments, for logging.
+func redactArgs(input string, args []string) []string {
+	redact := logRedactor(input)
+	ret := make([]string, 0, len(args))
+	for _, arg := range args {
+		ret = append(ret, string(redact([]byte(arg))))
+	}
+	return ret
+}
+
+// Redacts the log file in place, so that it can be stored without credentials.
+func redactLogFile(path, input string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, logRedactor(input)(b), 0666)
+}
+
+// Redacts whole lines and stops after maxLogSize bytes, including any truncation notes.
+type logWriter struct {
+	w         io.Writer
+	redact    func([]byte) []byte
+	pending   []byte
+	remaining int64
+}
+
+func newLogWriter(w io.Writer, input string) *logWriter {
+	return &logWriter{
+		w:      w,
+		redact: logRedactor(input),
+		// Leave room to note truncation.
+		remaining: max(maxLogSize-int64(len("\n"+logTruncatedNote)), 0),
+	}
+}
+
+func (lw *logWriter) Write(b []byte) (int, error) {
+	lw.pending = append(lw.pending, b...)
+	// ffmpeg ends its status lines with carriage returns.
+	i := bytes.LastIndexAny(lw.pending, "\r\n")
+	if i == -1 && len(lw.pending) < maxLogLine {
+		return len(b), nil
+	}
+	if i == -1 {
+		i = len(lw.pending) - 1
+	}
+	err := lw.write(lw.pending[:i+1])
+	lw.pending = append(lw.pending[:0], lw.pending[i+1:]...)
+	return len(b), err
+}
+
+func (lw *logWriter) write(b []byte) error {
+	b = lw.redact(b)
+	if int64(len(b)) > lw.remaining {
+		lw.w.Write(b[:lw.remaining])
+		lw.remaining = 0
+		io.WriteString(lw.w, "\n"+logTruncatedNote)
+		return errLogLimit
+	}
+	lw.remaining -= int64(len(b))
+	_, err := lw.w.Write(b)
+	return err
+}
+
+// Writes any partial last line.
+func (lw *logWriter) Close() error {
+	if len(lw.pending) == 0 {
+		return nil
+	}
+	err := lw.write(lw.pending)
+	lw.pending = nil
+	return err
+}
+
+func (lw *logWriter) flush() {
+	if f, ok := lw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Copies as much of the end of the log as the writer has room for, skipping the partial first line
+// if it's cut.
+func copyLogTail(lw *logWriter, r io.ReaderAt, size int64) error {
+	if size <= lw.remaining {
+		_, err := io.Copy(lw, io.NewSectionReader(r, 0, size))
+		return err
+	}
+	if err := lw.write([]byte(logTruncatedNote)); err != nil {
+		return err
+	}
+	tail := io.NewSectionReader(r, size-lw.remaining, lw.remaining)
+	var b [1]byte
+	for {
+		if _, err := tail.Read(b[:]); err != nil || b[0] == '\n' {
+			break
+		}
+	}
+	_, err := io.Copy(lw, tail)
+	return err
+}
+
+// Serves the ffmpeg log of the job. The log of a running job is followed until it finishes.
+func (t *Transcoder) serveLog(w http.ResponseWriter, r *http.Request, j job) {
+	logName := j.outputName + ".log"
+	livePath := filepath.Join(t.OutputDir, logName)
+	running := func() bool {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.operations[j.outputName] != nil
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	lw := newLogWriter(w, j.input)
+	defer lw.Close()
+	if running() {
+		followLog(r.Context(), lw, livePath, running)
+		return
+	}
+	// Logs of completed jobs are cached. Failed jobs leave theirs behind.
+	if loc, err := t.RP.NewInstance(logName); err == nil {
+		if fi, err := loc.Stat(); err == nil {
+			copyLogTail(lw, loc, fi.Size())
+			return
+		}
+	}
+	f, err := os.Open(livePath)
+	if err != nil {
+		http.Error(w, "no log", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		log.Printf("error statting log %q: %v", livePath, err)
+		http.Error(w, "error reading log", http.StatusInternalServerError)
+		return
+	}
+	copyLogTail(lw, f, fi.Size())
+}
+
+// Copies the log as it's written until running returns false or ctx is done. The log might not
+// exist until the job starts converting.
+func followLog(ctx context.Context, lw *logWriter, path string, running func() bool) {
+	var f *os.File
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	for {
+		// Check before reading so that everything written before the job ended is read.
+		stillRunning := running()
+		if f == nil {
+			f, _ = os.Open(path)
+			if f != nil {
+				if fi, err := f.Stat(); err == nil && fi.Size() > lw.remaining {
+					if copyLogTail(lw, f, fi.Size()) != nil {
+						return
+					}
+					f.Seek(fi.Size(), io.SeekStart)
+				}
+			}
+		}
+		if f != nil {
+			if _, err := io.Copy(lw, f); err != nil {
+				return
+			}
+		}
+		lw.flush()
+		if !stillRunning {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(logFollowInterval):
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package transcoder
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type metrics struct {
+	registry         *prometheus.Registry
+	jobsStarted      prometheus.Counter
+	jobsFinished     *prometheus.CounterVec
+	downloadBytes    *prometheus.CounterVec
+	stageDuration    *prometheus.HistogramVec
+	realtimeFactor   prometheus.Histogram
+	cacheRequests    *prometheus.CounterVec
+	waitingRequests  prometheus.Gauge
+	shedRequests     prometheus.Counter
+	eventSubscribers prometheus.Gauge
+}
+
+func (t *Transcoder) initMetrics() {
+	m := &t.metrics
+	m.registry = prometheus.NewRegistry()
+	m.jobsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "transcoder_jobs_started_total",
+		Help: "Transcode jobs started.",
+	})
+	m.jobsFinished = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transcoder_jobs_finished_total",
+		Help: "Transcode jobs finished, by final state and the last stage reached.",
+	}, []string{"state", "stage"})
+	m.downloadBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transcoder_download_bytes_total",
+		Help: "Bytes of input downloaded over HTTP, or read from torrents, by source.",
+	}, []string{"source"})
+	m.stageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "transcoder_stage_duration_seconds",
+		Help:    "Time spent in each job stage.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+	}, []string{"stage"})
+	m.realtimeFactor = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "transcoder_convert_realtime_factor",
+		Help:    "Duration converted divided by the time taken to convert it.",
+		Buckets: prometheus.ExponentialBuckets(0.125, 2, 10),
+	})
+	m.cacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "transcoder_cache_requests_total",
+		Help: "Output requests, by whether the output was already cached.",
+	}, []string{"result"})
+	m.waitingRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transcoder_waiting_requests",
+		Help: "HTTP requests waiting on a job to complete.",
+	})
+	m.shedRequests = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "transcoder_shed_requests_total",
+		Help: "Requests rejected because the transcoder was saturated.",
+	})
+	m.eventSubscribers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "transcoder_event_subscribers",
+		Help: "Active progress event subscribers.",
+	})
+	m.registry.MustRegister(
+		m.jobsStarted,
+		m.jobsFinished,
+		m.downloadBytes,
+		m.stageDuration,
+		m.realtimeFactor,
+		m.cacheRequests,
+		m.waitingRequests,
+		m.shedRequests,
+		m.eventSubscribers,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "transcoder_operations",
+			Help: "Jobs currently running or queued.",
+		}, func() float64 {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			return float64(len(t.operations))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "transcoder_queued_jobs",
+			Help: "Jobs waiting to start.",
+		}, func() float64 {
+			return float64(t.queuedJobs())
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+func (t *Transcoder) queuedJobs() (n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, op := range t.operations {
+		op.mu.Lock()
+		if op.Progress.Queued {
+			n++
+		}
+		op.mu.Unlock()
+	}
+	return
+}
+
+func (m *metrics) jobFinished(res JobResult) {
+	m.jobsFinished.WithLabelValues(string(res.State), res.LastStage()).Inc()
+	for name, st := range res.Stages {
+		if st.Started.IsZero() || st.Finished.IsZero() {
+			continue
+		}
+		m.stageDuration.WithLabelValues(name).Observe(st.Finished.Sub(st.Started).Seconds())
+	}
+	// Clips only convert part of the input.
+	converted := res.OutputDuration
+	if converted == 0 {
+		converted = res.InputDuration
+	}
+	if convert := res.Stages["convert"]; res.State == JobCompleted && converted > 0 {
+		if d := convert.Finished.Sub(convert.Started); d > 0 {
+			m.realtimeFactor.Observe(converted.Seconds() / d.Seconds())
+		}
+	}
+}
+
+func (t *Transcoder) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	promhttp.HandlerFor(t.metrics.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
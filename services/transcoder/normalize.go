@@ -0,0 +1,12 @@
+package transcoder
+
+import "github.com/anacrolix/webtorrent-public/services/transcoder/api"
+
+// Rules for reducing inputs to an identity, so that requests for the same content share an output
+// name. See api.InputNormalization.
+type InputNormalization = api.InputNormalization
+
+// Sets the job's identity from its input, which determines the output name.
+func (t *Transcoder) identify(j *job) {
+	j.identity, j.identityPath = t.InputNormalization.Identity(j.input, j.inputPath)
+}
@@ -0,0 +1,25 @@
+package transcoder
+
+import (
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNormalizedOutputNames(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.InputNormalization.Gateways = []string{"gateway.example.com"}
+		tc.InputNormalization.VolatileParams = []string{"sig"}
+	})
+	const ih = "30764610642571b3c01af11d6ce60cfa164d7ee3"
+	viaTorrent := tc.newJob(url.Values{"i": {ih}, "path": {"dir/a.avi"}, "f": {"mp4"}})
+	viaGateway := tc.newJob(url.Values{
+		"i": {"https://gateway.example.com/" + ih + "/file?path=dir%2Fa.avi&sig=1"},
+		"f": {"mp4"},
+	})
+	qtc.Check(viaGateway.outputName, qt.Equals, viaTorrent.outputName)
+	// The input is still fetched as given.
+	qtc.Check(viaGateway.input, qt.Equals, "https://gateway.example.com/"+ih+"/file?path=dir%2Fa.avi&sig=1")
+}
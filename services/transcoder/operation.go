@@ -2,6 +2,7 @@ package transcoder
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/anacrolix/missinggo/v2/panicif"
@@ -10,36 +11,102 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/anacrolix/ffprobe"
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/perf"
 	"github.com/anacrolix/sync"
+	"github.com/anacrolix/torrent"
 )
 
-func probeDuration(input string) (d time.Duration, err error) {
+func probeDuration(ctx context.Context, ffprobePath, input string) (d time.Duration, err error) {
 	defer perf.ScopeTimer()()
-	info, err := ffprobe.Run(input)
+	if ffprobePath != "" {
+		return probeDurationWith(ctx, ffprobePath, input)
+	}
+	pc, err := ffprobe.Start(input)
 	if err != nil {
 		err = fmt.Errorf("error probing: %s", err)
 		return
 	}
-	return info.Duration()
+	select {
+	case <-ctx.Done():
+		pc.Cmd.Process.Kill()
+		err = context.Cause(ctx)
+		return
+	case <-pc.Done:
+	}
+	if pc.Err != nil {
+		err = fmt.Errorf("error probing: %s", pc.Err)
+		return
+	}
+	return pc.Info.Duration()
+}
+
+// Probes with the given ffprobe, which the ffprobe package doesn't support.
+func probeDurationWith(ctx context.Context, ffprobePath, input string) (time.Duration, error) {
+	out, err := exec.CommandContext(
+		ctx, ffprobePath,
+		"-v", "error",
+		"-show_entries", "format=duration",
+		"-of", "default=noprint_wrappers=1:nokey=1",
+		input,
+	).Output()
+	if err != nil {
+		return 0, fmt.Errorf("error probing: %w", err)
+	}
+	secs, err := strconv.ParseFloat(strings.TrimSpace(string(out)), 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing duration: %w", err)
+	}
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// Returns ffprobe's description of the input's format and streams. An empty ffprobePath uses
+// ffprobe from PATH.
+func Probe(ctx context.Context, ffprobePath, input string) (*ffprobe.Info, error) {
+	if ffprobePath == "" {
+		ffprobePath = "ffprobe"
+	}
+	cmd := exec.CommandContext(
+		ctx, ffprobePath,
+		"-v", "error",
+		"-show_format",
+		"-show_streams",
+		"-of", "json",
+		input,
+	)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error probing: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var info ffprobe.Info
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, fmt.Errorf("error parsing ffprobe output: %w", err)
+	}
+	return &info, nil
 }
 
-func probeDurationSettingProgress(input string, set func(func(*Progress))) {
+func probeDurationSettingProgress(ctx context.Context, ffprobePath, input string, c clip, set func(func(*Progress))) {
 	set(func(p *Progress) {
 		p.Probing = true
 	})
-	dur, err := probeDuration(input)
+	dur, err := probeDuration(ctx, ffprobePath, input)
 	if err != nil {
 		log.Printf("error probing duration: %s", err)
+		// A clip's length can be known anyway.
+		dur = 0
 	}
 	set(func(p *Progress) {
 		if err == nil {
 			p.InputDuration = dur
 		}
+		p.OutputDuration = c.length(dur)
 		p.Probing = false
 	})
 }
@@ -68,10 +135,13 @@ func downloadInput(ctx context.Context, url, to string, progress func(progress f
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("got status code %d", resp.StatusCode)
 	}
+	// Downloads are moved into place when complete, so any file at to is a complete input.
+	part := to + ".part"
+	defer os.Remove(part)
 	errChan := make(chan error, 1)
 	go func() {
 		errChan <- func() error {
-			f, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 			if err != nil {
 				return err
 			}
@@ -86,7 +156,10 @@ func downloadInput(ctx context.Context, url, to string, progress func(progress f
 			if err != nil {
 				return err
 			}
-			return f.Close()
+			if err := f.Close(); err != nil {
+				return err
+			}
+			return os.Rename(part, to)
 		}()
 	}()
 	select {
@@ -109,22 +182,37 @@ func updateDownloadProgress(f func(func(*Progress))) func(float64) {
 
 func transcode(
 	ctx context.Context,
-	url, tempFilePath, logPath, outputName string,
-	args []string,
+	input, logPath, outputName string,
+	// Fetches the input before conversion, if it isn't streamed to ffmpeg.
+	download func(ctx context.Context, progress func(float64)) error,
+	// Empty uses the ffprobe package's default.
+	ffprobePath string,
+	// The part of the input being converted, for progress.
+	c clip,
+	// Returns the ffmpeg command, once the input is available.
+	prepare func(context.Context) ([]string, error),
+	// The ffmpeg process is moved into this cgroup directory, if set.
+	cgroup string,
 	updateProgress func(func(*Progress)),
 ) error {
-	updateProgress(func(p *Progress) {
-		p.Downloading = true
-	})
-	defer os.Remove(tempFilePath)
-	if err := downloadInput(ctx, url, tempFilePath, updateDownloadProgress(updateProgress)); err != nil {
-		return fmt.Errorf("error downloading %q: %w", url, err)
+	if download != nil {
+		updateProgress(func(p *Progress) {
+			p.Downloading = true
+		})
+		if err := download(ctx, updateDownloadProgress(updateProgress)); err != nil {
+			return err
+		}
+		updateProgress(func(p *Progress) {
+			p.Downloading = false
+		})
 	}
-	updateProgress(func(p *Progress) {
-		p.Downloading = false
-	})
 
-	go probeDurationSettingProgress(tempFilePath, updateProgress)
+	go probeDurationSettingProgress(ctx, ffprobePath, input, c, updateProgress)
+
+	args, err := prepare(ctx)
+	if err != nil {
+		return err
+	}
 
 	os.MkdirAll(filepath.Dir(logPath), 0750)
 	// Log files are left behind by failed runs, so don't try again if it
@@ -142,7 +230,7 @@ func transcode(
 		cmd.Err = nil
 	}
 	cmd.Stderr = logFile
-	log.Printf("invoking %q", args)
+	log.Printf("invoking %q", redactArgs(input, args))
 	started := time.Now()
 	defer func() {
 		log.Printf("%v ran for %v", outputName, time.Since(started))
@@ -153,13 +241,66 @@ func transcode(
 	updateProgress(func(p *Progress) {
 		p.Converting = true
 	})
-	return cmd.Run()
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	if cgroup != "" {
+		if err := addToCgroup(cgroup, cmd.Process.Pid); err != nil {
+			log.Levelf(log.Warning, "error adding ffmpeg for %q to cgroup: %v", outputName, err)
+		}
+	}
+	err = cmd.Wait()
+	if err != nil && ctx.Err() == nil {
+		err = fmt.Errorf("running ffmpeg: %w: %s", err, logTail(logPath))
+	}
+	return err
+}
+
+// Returns the last line of the log, which is usually the reason ffmpeg failed.
+func logTail(logPath string) string {
+	f, err := os.Open(logPath)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	if end, err := f.Seek(0, io.SeekEnd); err == nil && end > 4096 {
+		f.Seek(-4096, io.SeekEnd)
+	} else {
+		f.Seek(0, io.SeekStart)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return err.Error()
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	return lines[len(lines)-1]
 }
 
 type operation struct {
 	mu        sync.Mutex
 	Progress  Progress
 	sendEvent func()
+	// Set for inputs streamed from a torrent.
+	torrentFile *torrent.File
+	started     time.Time
+	stages      map[string]StageTimes
+	outputSize  int64
+	// The last time the progress changed.
+	lastActivity time.Time
+	// The last time more of a torrent input was downloaded.
+	lastDownload time.Time
+	limits       ResourceLimits
+}
+
+func newOperation(sendEvent func()) *operation {
+	now := time.Now()
+	return &operation{
+		sendEvent:    sendEvent,
+		started:      now,
+		lastActivity: now,
+		stages:       make(map[string]StageTimes),
+	}
 }
 
 func (op *operation) updateProgress(f func(p *Progress)) {
@@ -169,6 +310,40 @@ func (op *operation) updateProgress(f func(p *Progress)) {
 	f(&op.Progress)
 	if op.Progress != before {
 		// log.Printf("%#v", op.Progress)
+		op.Progress.Version = progressVersion.Add(1)
+		now := time.Now()
+		op.lastActivity = now
+		if op.Progress.DownloadProgress != before.DownloadProgress {
+			op.lastDownload = now
+		}
+		op.recordStages(before, now)
 		op.sendEvent()
 	}
 }
+
+// Records stage times from changes in the progress flags.
+func (op *operation) recordStages(before Progress, now time.Time) {
+	after := op.Progress
+	for _, s := range []struct {
+		name          string
+		before, after bool
+	}{
+		{"queue", before.Queued, after.Queued},
+		{"download", before.Downloading, after.Downloading},
+		{"probe", before.Probing, after.Probing},
+		{"analyze", before.Analyzing, after.Analyzing},
+		{"convert", before.Converting, after.Converting},
+		{"store", before.Storing, after.Storing},
+	} {
+		if s.before == s.after {
+			continue
+		}
+		st := op.stages[s.name]
+		if s.after {
+			st.Started = now
+		} else {
+			st.Finished = now
+		}
+		op.stages[s.name] = st
+	}
+}
@@ -0,0 +1,153 @@
+package transcoder
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"strings"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/resource"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// Each output is stored with one of these, as JSON in <output name>.key.
+const outputKeySuffix = ".key"
+
+// Records what went into an output's name.
+type OutputKey = api.OutputKey
+
+// Served by /explain.
+type KeyExplanation = api.KeyExplanation
+
+// The version of ffmpeg, as reported by the first line of -version. Looked up once.
+func (t *Transcoder) ffmpegVersion() string {
+	t.ffmpegVersionOnce.Do(func() {
+		out, err := exec.Command(t.ffmpegPath(), "-version").Output()
+		if err != nil {
+			log.Levelf(log.Warning, "error getting ffmpeg version: %v", err)
+		}
+		t.ffmpegVersionValue = firstLine(out)
+	})
+	return t.ffmpegVersionValue
+}
+
+// Returns the job's key under the current settings. The job's own output name isn't used.
+func (t *Transcoder) outputKey(j job) OutputKey {
+	k := OutputKey{Generation: t.Generation}
+	salt := make([]string, 0, 2)
+	if t.Generation != "" {
+		salt = append(salt, "generation="+t.Generation)
+	}
+	if t.KeyByFFmpegVersion {
+		k.FFmpegVersion = t.ffmpegVersion()
+		salt = append(salt, "ffmpeg="+k.FFmpegVersion)
+	}
+	k.Hashed = j.hashedStrings(salt)
+	j.setOutputName(salt)
+	k.OutputName = j.outputName
+	return k
+}
+
+// Returns the job given by the query, named according to the InputNormalization, Generation and
+// ffmpeg version. Audio outputs must be in one of the AudioFormats.
+func (t *Transcoder) newJob(q url.Values) job {
+	j := jobFromQuery(q)
+	if j.audio != nil && j.invalid == nil {
+		if _, ok := t.audioFormats()[j.format]; !ok {
+			j.invalid = fmt.Errorf("unknown audio format %q", j.format)
+		}
+	}
+	t.identify(&j)
+	j.outputName = t.outputKey(j).OutputName
+	return j
+}
+
+// Stores what went into the output's name beside it.
+func (t *Transcoder) storeOutputKey(j job) {
+	k := t.outputKey(j)
+	b, err := json.Marshal(k)
+	if err == nil {
+		var loc resource.Instance
+		loc, err = t.RP.NewInstance(j.outputName + outputKeySuffix)
+		if err == nil {
+			err = loc.Put(bytes.NewReader(b))
+		}
+	}
+	if err != nil {
+		log.Levelf(log.Warning, "error storing key of %q: %v", j.outputName, err)
+	}
+}
+
+func (t *Transcoder) storedOutputKey(outputName string) (k *OutputKey, err error) {
+	loc, err := t.RP.NewInstance(outputName + outputKeySuffix)
+	if err != nil {
+		return
+	}
+	rc, err := loc.Get()
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+	err = json.NewDecoder(rc).Decode(&k)
+	return
+}
+
+// Reports whether the name is that of an output, rather than of a file stored beside one.
+func IsOutputName(name string) bool {
+	return jobFileRegexp.MatchString(name) &&
+		!strings.HasSuffix(name, ".log") &&
+		!strings.HasSuffix(name, outputKeySuffix)
+}
+
+// Reports whether the stored output was made with a Generation or ffmpeg version other than the
+// current one, and so will never be served again. Outputs stored without a key predate
+// generations, and are superseded once one is set.
+func (t *Transcoder) Superseded(outputName string) bool {
+	k, err := t.storedOutputKey(outputName)
+	if err != nil {
+		return t.Generation != "" || t.KeyByFFmpegVersion
+	}
+	if k.Generation != t.Generation {
+		return true
+	}
+	return t.KeyByFFmpegVersion && k.FFmpegVersion != t.ffmpegVersion()
+}
+
+// Deletes the output, and the log and key stored with it.
+func (t *Transcoder) RemoveOutput(outputName string) error {
+	for _, name := range []string{outputName + ".log", outputName + outputKeySuffix, outputName} {
+		loc, err := t.RP.NewInstance(name)
+		if err != nil {
+			return err
+		}
+		if err := loc.Delete(); err != nil && name == outputName {
+			return err
+		}
+	}
+	return nil
+}
+
+// Explains how the request maps to its output name.
+func (t *Transcoder) serveExplain(w http.ResponseWriter, r *http.Request) {
+	e := KeyExplanation{OutputKey: t.outputKey(t.newJob(r.URL.Query()))}
+	loc, err := t.RP.NewInstance(e.OutputName)
+	if err != nil {
+		log.Print(err)
+		http.Error(w, "bad output location", http.StatusInternalServerError)
+		return
+	}
+	e.Cached = resource.Exists(loc)
+	t.mu.Lock()
+	e.Running = t.jobs[e.OutputName] != nil
+	t.mu.Unlock()
+	if e.Cached {
+		e.Stored, _ = t.storedOutputKey(e.OutputName)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(e)
+}
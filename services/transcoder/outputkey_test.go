@@ -0,0 +1,81 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/anacrolix/missinggo/v2/resource"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestOutputKey(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	q := url.Values{"i": {"http://example.com/a.avi"}, "f": {"mp4"}, "opt": {"-c:v", "libx264"}}
+	// Without a generation, names are as they've always been.
+	unversioned := jobFromQuery(q)
+	qtc.Check(tc.newJob(q).outputName, qt.Equals, unversioned.outputName)
+	qtc.Check(IsOutputName(unversioned.outputName), qt.IsTrue)
+	qtc.Check(IsOutputName(unversioned.outputName+".log"), qt.IsFalse)
+	qtc.Check(IsOutputName(unversioned.outputName+outputKeySuffix), qt.IsFalse)
+
+	store := func(j job) {
+		loc, err := tc.RP.NewInstance(j.outputName)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Assert(loc.Put(strings.NewReader("output")), qt.IsNil)
+		tc.storeOutputKey(j)
+	}
+	store(unversioned)
+	qtc.Check(tc.Superseded(unversioned.outputName), qt.IsFalse)
+
+	tc.Generation = "2"
+	j := tc.newJob(q)
+	qtc.Check(j.outputName, qt.Not(qt.Equals), unversioned.outputName)
+	qtc.Check(tc.Superseded(unversioned.outputName), qt.IsTrue)
+	store(j)
+	qtc.Check(tc.Superseded(j.outputName), qt.IsFalse)
+
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/explain?"+q.Encode(), nil))
+	qtc.Assert(w.Code, qt.Equals, http.StatusOK)
+	var e KeyExplanation
+	qtc.Assert(json.NewDecoder(w.Body).Decode(&e), qt.IsNil)
+	qtc.Check(e.OutputName, qt.Equals, j.outputName)
+	qtc.Check(e.Hashed, qt.DeepEquals, []string{"-c:v", "libx264", "http://example.com/a.avi", "generation=2"})
+	qtc.Check(e.Generation, qt.Equals, "2")
+	qtc.Check(e.Cached, qt.IsTrue)
+	qtc.Check(e.Running, qt.IsFalse)
+	qtc.Assert(e.Stored, qt.IsNotNil)
+	qtc.Check(*e.Stored, qt.DeepEquals, e.OutputKey)
+
+	tc.Generation = "3"
+	qtc.Check(tc.Superseded(j.outputName), qt.IsTrue)
+	qtc.Assert(tc.RemoveOutput(j.outputName), qt.IsNil)
+	for _, name := range []string{j.outputName, j.outputName + outputKeySuffix} {
+		loc, err := tc.RP.NewInstance(name)
+		qtc.Assert(err, qt.IsNil)
+		qtc.Check(resource.Exists(loc), qt.IsFalse)
+	}
+}
+
+func TestKeyByFFmpegVersion(t *testing.T) {
+	qtc := qt.New(t)
+	ffmpeg := filepath.Join(t.TempDir(), "ffmpeg")
+	qtc.Assert(os.WriteFile(ffmpeg, []byte(fakeFFmpeg), 0755), qt.IsNil)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.FFmpegPath = ffmpeg
+		tc.KeyByFFmpegVersion = true
+	})
+	q := url.Values{"i": {"http://example.com/a.avi"}, "f": {"mp4"}}
+	j := tc.newJob(q)
+	k := tc.outputKey(j)
+	qtc.Check(k.FFmpegVersion, qt.Matches, "ffmpeg version 6.0 .*")
+	qtc.Check(k.Hashed[len(k.Hashed)-1], qt.Equals, "ffmpeg="+k.FFmpegVersion)
+	qtc.Check(j.outputName, qt.Not(qt.Equals), jobFromQuery(q).outputName)
+}
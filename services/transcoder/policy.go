@@ -0,0 +1,112 @@
+package transcoder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
+
+// Restricts the inputs jobs may use. The zero value allows HTTP, HTTPS and torrent inputs from any
+// host.
+type InputPolicy struct {
+	// URL schemes allowed for inputs that aren't torrents, such as "https". Empty allows
+	// defaultInputSchemes. Others, such as "file", must be allowed explicitly.
+	Schemes []string `json:",omitempty"`
+	// Host patterns, matched with path.Match, that inputs may be fetched from. Empty allows any.
+	Hosts []string `json:",omitempty"`
+	// Refuse magnet URIs and infohashes.
+	DenyTorrents bool `json:",omitempty"`
+}
+
+// ffmpeg can read many more protocols, including local files, so only these are allowed unless
+// configured otherwise.
+var defaultInputSchemes = []string{"http", "https"}
+
+var (
+	errInputDenied   = errors.New("input not allowed")
+	errWebhookDenied = errors.New("webhook not allowed")
+)
+
+func (p InputPolicy) check(input string, torrentsEnabled bool) error {
+	if torrentsEnabled && torrents.IsRef(input) {
+		if p.DenyTorrents {
+			return fmt.Errorf("%w: torrents are disabled", errInputDenied)
+		}
+		return nil
+	}
+	u, err := url.Parse(input)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInputDenied, err)
+	}
+	schemes := p.Schemes
+	if len(schemes) == 0 {
+		schemes = defaultInputSchemes
+	}
+	if !containsFold(schemes, u.Scheme) {
+		return fmt.Errorf("%w: scheme %q", errInputDenied, u.Scheme)
+	}
+	if len(p.Hosts) != 0 && !matchesAny(p.Hosts, u.Hostname()) {
+		return fmt.Errorf("%w: host %q", errInputDenied, u.Hostname())
+	}
+	return nil
+}
+
+func containsFold(ss []string, s string) bool {
+	for _, e := range ss {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches case-insensitively with path.Match.
+func matchesAny(patterns []string, s string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(s)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhooks given in requests are fetched by the server, so they're only allowed to configured
+// hosts.
+func (t *Transcoder) checkWebhooks(urls []string) error {
+	for _, s := range urls {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errWebhookDenied, err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("%w: scheme %q", errWebhookDenied, u.Scheme)
+		}
+		if !matchesAny(t.WebhookHosts, u.Hostname()) {
+			return fmt.Errorf("%w: host %q", errWebhookDenied, u.Hostname())
+		}
+	}
+	return nil
+}
+
+// Responds with 400 and returns false if the job's parameters are invalid, or 403 if its input
+// or webhooks aren't allowed.
+func (t *Transcoder) checkInput(w http.ResponseWriter, j job) bool {
+	if j.invalid != nil {
+		http.Error(w, j.invalid.Error(), http.StatusBadRequest)
+		return false
+	}
+	err := t.InputPolicy.check(j.input, t.TorrentClient != nil)
+	if err == nil {
+		err = t.checkWebhooks(j.webhooks)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
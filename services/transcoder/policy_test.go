@@ -0,0 +1,42 @@
+package transcoder
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestInputPolicy(t *testing.T) {
+	qtc := qt.New(t)
+	p := InputPolicy{
+		Schemes:      []string{"https"},
+		Hosts:        []string{"*.example.com"},
+		DenyTorrents: true,
+	}
+	qtc.Check(p.check("https://cdn.example.com/a.avi", false), qt.IsNil)
+	qtc.Check(p.check("http://cdn.example.com/a.avi", false), qt.ErrorMatches, `input not allowed: scheme "http"`)
+	qtc.Check(p.check("https://evil.com/a.avi", false), qt.ErrorMatches, `input not allowed: host "evil.com"`)
+	infohash := "0123456789abcdef0123456789abcdef01234567"
+	qtc.Check(errors.Is(p.check(infohash, true), errInputDenied), qt.IsTrue)
+	// Without a torrent client, infohashes are treated like any other URL.
+	qtc.Check(p.check(infohash, false), qt.ErrorMatches, `input not allowed: scheme ""`)
+	// Only HTTP and torrent inputs are allowed by default.
+	qtc.Check(InputPolicy{}.check("http://evil.com/a.avi", false), qt.IsNil)
+	qtc.Check(InputPolicy{}.check(infohash, true), qt.IsNil)
+	qtc.Check(InputPolicy{}.check("file:///etc/passwd", false), qt.ErrorMatches, `input not allowed: scheme "file"`)
+	qtc.Check(InputPolicy{}.check("/etc/passwd", false), qt.ErrorMatches, `input not allowed: scheme ""`)
+	qtc.Check(InputPolicy{Schemes: []string{"file"}}.check("file:///srv/a.avi", false), qt.IsNil)
+
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.InputPolicy = p
+	})
+	w := httptest.NewRecorder()
+	q := url.Values{"i": {"https://evil.com/a.avi"}, "f": {"mp4"}}
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+	qtc.Check(w.Code, qt.Equals, http.StatusForbidden)
+	qtc.Check(tc.jobs, qt.HasLen, 0)
+}
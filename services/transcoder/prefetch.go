@@ -0,0 +1,128 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/resource"
+)
+
+// Outputs whose last job failed within this long aren't prefetched again.
+var prefetchFailureBackoff = 10 * time.Minute
+
+// An output to warm the cache with.
+type PrefetchEntry struct {
+	Input string
+	// The file within the torrent, when the input is a magnet URI or infohash.
+	Path   string `json:",omitempty"`
+	Format string
+	// Names the output options in Transcoder.Presets. Empty means no options.
+	Preset string `json:",omitempty"`
+}
+
+type PrefetchResult struct {
+	JobRef
+	// "queued", "running", "cached", "failed" if the output failed recently, or "rejected".
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// Records or clears recent failures, which prefetching skips.
+func (t *Transcoder) recordFailure(res JobResult) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name, failed := range t.recentFailures {
+		if res.Finished.Sub(failed) >= prefetchFailureBackoff {
+			delete(t.recentFailures, name)
+		}
+	}
+	if res.State == JobFailed {
+		t.recentFailures[res.OutputName] = res.Finished
+	} else {
+		delete(t.recentFailures, res.OutputName)
+	}
+}
+
+// Starts background jobs at prefetch priority for a JSON list of PrefetchEntry, responding with a
+// PrefetchResult for each.
+func (t *Transcoder) servePrefetch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var entries []PrefetchEntry
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&entries)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("error decoding entries: %v", err), http.StatusBadRequest)
+		return
+	}
+	client := t.requestClient(r)
+	results := make([]PrefetchResult, 0, len(entries))
+	for _, e := range entries {
+		results = append(results, t.prefetch(e, client))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+func (t *Transcoder) prefetch(e PrefetchEntry, client string) (res PrefetchResult) {
+	res.Status = "rejected"
+	if e.Input == "" || e.Format == "" {
+		res.Error = "input and format are required"
+		return
+	}
+	opts, ok := t.Presets[e.Preset]
+	if e.Preset != "" && !ok {
+		res.Error = fmt.Sprintf("unknown preset %q", e.Preset)
+		return
+	}
+	q := url.Values{"i": {e.Input}, "f": {e.Format}, "opt": opts}
+	if e.Path != "" {
+		q.Set("path", e.Path)
+	}
+	j := t.newJob(q)
+	j.priority = PriorityPrefetch
+	j.client = client
+	res.JobRef = newJobRef(j.outputName, q.Encode())
+	if err := t.InputPolicy.check(j.input, t.TorrentClient != nil); err != nil {
+		res.Error = err.Error()
+		return
+	}
+	outputLoc, err := t.RP.NewInstance(j.outputName)
+	if err != nil {
+		res.Error = err.Error()
+		return
+	}
+	if resource.Exists(outputLoc) {
+		res.Status = "cached"
+		return
+	}
+	t.mu.Lock()
+	failed, recentlyFailed := t.recentFailures[j.outputName]
+	running := t.jobs[j.outputName] != nil
+	if running {
+		// Only raise its priority. Detaching it would keep it running after its viewers leave.
+		t.sched.bump(j.outputName, j.priority)
+	}
+	t.mu.Unlock()
+	switch {
+	case running:
+		res.Status = "running"
+		return
+	case recentlyFailed && time.Since(failed) < prefetchFailureBackoff:
+		res.Status = "failed"
+		return
+	default:
+		if _, shed := t.shouldShed(j, false); shed {
+			res.Error = "transcoder is busy"
+			return
+		}
+		res.Status = "queued"
+	}
+	t.startJob(j, true)
+	return
+}
@@ -0,0 +1,78 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestPrefetch(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.Presets = map[string][]string{"small": {"-vf", "scale=320:-1"}}
+	})
+	hanging := hangingJob(t)
+	cached := jobFromQuery(url.Values{"i": {"http://example.com/cached.avi"}, "f": {"webm"}})
+	loc, err := tc.RP.NewInstance(cached.outputName)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(loc.Put(strings.NewReader("output")), qt.IsNil)
+	failed := jobFromQuery(url.Values{
+		"i":   {"http://example.com/failed.avi"},
+		"f":   {"mp4"},
+		"opt": {"-vf", "scale=320:-1"},
+	})
+	tc.recordFailure(JobResult{OutputName: failed.outputName, State: JobFailed, Finished: time.Now()})
+
+	body, err := json.Marshal([]PrefetchEntry{
+		{Input: hanging.input, Format: hanging.format},
+		{Input: cached.input, Format: cached.format},
+		{Input: failed.input, Format: failed.format, Preset: "small"},
+		{Input: hanging.input, Format: "mp4", Preset: "huge"},
+		{Input: hanging.input},
+	})
+	qtc.Assert(err, qt.IsNil)
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/prefetch", strings.NewReader(string(body))))
+	qtc.Assert(w.Code, qt.Equals, http.StatusOK)
+	var results []PrefetchResult
+	qtc.Assert(json.NewDecoder(w.Body).Decode(&results), qt.IsNil)
+	qtc.Assert(results, qt.HasLen, 5)
+	var statuses []string
+	for _, res := range results {
+		statuses = append(statuses, res.Status)
+	}
+	qtc.Check(statuses, qt.DeepEquals, []string{"queued", "cached", "failed", "rejected", "rejected"})
+	qtc.Check(results[0].OutputName, qt.Equals, hanging.outputName)
+	qtc.Check(results[2].OutputName, qt.Equals, failed.outputName)
+	qtc.Check(results[3].Error, qt.Equals, `unknown preset "huge"`)
+
+	tc.mu.Lock()
+	rj := tc.jobs[hanging.outputName]
+	tc.mu.Unlock()
+	qtc.Assert(rj, qt.IsNotNil)
+	qtc.Check(rj.detached, qt.IsTrue)
+	rj.cancel(errors.New("test over"))
+	<-rj.done
+}
+
+// Prefetching a job someone is watching leaves it to be cancelled when they leave.
+func TestPrefetchRunningJob(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	j := hangingJob(t)
+	rj := tc.startJob(j, false)
+	res := tc.prefetch(PrefetchEntry{Input: j.input, Format: j.format}, "")
+	qtc.Check(res.Status, qt.Equals, "running")
+	tc.mu.Lock()
+	qtc.Check(rj.detached, qt.IsFalse)
+	tc.mu.Unlock()
+	leaveJob(t, tc, rj)
+	qtc.Check(isDone(rj, 5*time.Second), qt.IsTrue)
+}
@@ -1,24 +1,18 @@
 package transcoder
 
 import (
-	"time"
+	"sync/atomic"
 
 	g "github.com/anacrolix/generics"
 	"github.com/anacrolix/missinggo/v2/resource"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
 )
 
-type Progress struct {
-	Ready            bool
-	Downloading      bool
-	DownloadProgress float64
-	Probing          bool
-	Converting       bool
-	ConvertPos       time.Duration
-	InputDuration    time.Duration
-	Queued           bool
-	Storing          bool
-	StoreProgress    g.Option[float64]
-}
+type Progress = api.Progress
+
+// The source of Progress.Version.
+var progressVersion atomic.Uint64
 
 func (t *Transcoder) getProgress(outputLoc resource.Instance, outputName string) g.Option[Progress] {
 	if resource.Exists(outputLoc) {
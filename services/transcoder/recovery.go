@@ -0,0 +1,165 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/resource"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// Running jobs are recorded in OutputDir with this suffix, so they can be found after a restart.
+const journalSuffix = ".job"
+
+// Matches files in OutputDir that belong to a job.
+var jobFileRegexp = regexp.MustCompile(`^[0-9a-f]{32}\.`)
+
+// What's needed to restart a job.
+type journalEntry struct {
+	OutputName   string
+	Input        string
+	InputPath    string `json:",omitempty"`
+	Format       string
+	Options      []string
+	InputOptions []string
+	Start        time.Duration    `json:",omitempty"`
+	End          time.Duration    `json:",omitempty"`
+	Seek         string           `json:",omitempty"`
+	Audio        *AudioExtraction `json:",omitempty"`
+	Priority     Priority
+	Client       string   `json:",omitempty"`
+	Webhooks     []string `json:",omitempty"`
+	// Credentials were redacted from the input, so the job can't be restarted.
+	Redacted bool `json:",omitempty"`
+}
+
+func (t *Transcoder) journalPath(outputName string) string {
+	return filepath.Join(t.OutputDir, outputName+journalSuffix)
+}
+
+func (t *Transcoder) writeJournal(j job) {
+	t.mu.Lock()
+	webhooks := t.jobWebhooks[j.outputName]
+	t.mu.Unlock()
+	input := redactInput(j.input, j.input)
+	b, err := json.Marshal(journalEntry{
+		OutputName:   j.outputName,
+		Input:        input,
+		InputPath:    j.inputPath,
+		Format:       j.format,
+		Options:      j.opts,
+		InputOptions: j.iopts,
+		Start:        j.clip.Start,
+		End:          j.clip.End,
+		Seek:         j.clip.Seek,
+		Audio:        j.audio,
+		Priority:     j.priority,
+		Client:       j.client,
+		Webhooks:     webhooks,
+		Redacted:     input != j.input,
+	})
+	if err == nil {
+		os.MkdirAll(t.OutputDir, 0750)
+		err = os.WriteFile(t.journalPath(j.outputName), b, 0640)
+	}
+	if err != nil {
+		log.Levelf(log.Warning, "error journalling %q: %v", j.outputName, err)
+	}
+}
+
+func (e journalEntry) job() job {
+	return job{
+		outputName: e.OutputName,
+		input:      e.Input,
+		inputPath:  e.InputPath,
+		format:     e.Format,
+		opts:       e.Options,
+		iopts:      e.InputOptions,
+		clip:       clip{api.Clip{Start: e.Start, End: e.End, Seek: e.Seek}},
+		audio:      e.Audio,
+		priority:   e.Priority,
+		client:     e.Client,
+	}
+}
+
+// Cleans up after a previous process. Jobs it was running are restarted if RecoverJobs is set, and
+// reuse their downloaded inputs. Everything else a job leaves in OutputDir is removed, except the
+// logs of failed jobs. Call after Init, before serving requests.
+func (t *Transcoder) Recover() error {
+	entries, err := os.ReadDir(t.OutputDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	interrupted := make(map[string]journalEntry)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), journalSuffix) || !jobFileRegexp.MatchString(e.Name()) {
+			continue
+		}
+		path := filepath.Join(t.OutputDir, e.Name())
+		var je journalEntry
+		b, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(b, &je)
+		}
+		os.Remove(path)
+		if err != nil {
+			log.Levelf(log.Warning, "error reading journal %q: %v", path, err)
+			continue
+		}
+		if je.Redacted {
+			// Its input can't be fetched without the credentials, so it's cleaned up like any
+			// other leftover.
+			if t.RecoverJobs {
+				log.Printf("not restarting %q, as its input's credentials weren't journalled", je.OutputName)
+			}
+			continue
+		}
+		interrupted[je.OutputName] = je
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !jobFileRegexp.MatchString(name) || strings.HasSuffix(name, journalSuffix) {
+			continue
+		}
+		je, ok := interrupted[strings.TrimSuffix(strings.TrimSuffix(name, ".log"), ".input")]
+		switch {
+		case strings.HasSuffix(name, ".log") && !ok:
+			// A failed job's log.
+			continue
+		case strings.HasSuffix(name, ".input") && ok && t.RecoverJobs:
+			// Inputs are only moved into place once downloaded, so this can be reused.
+			log.Printf("keeping downloaded input for %q", je.OutputName)
+			continue
+		}
+		log.Printf("removing leftover %q", name)
+		os.Remove(filepath.Join(t.OutputDir, name))
+	}
+	if !t.RecoverJobs {
+		return nil
+	}
+	for _, je := range interrupted {
+		loc, err := t.RP.NewInstance(je.OutputName)
+		if err == nil && resource.Exists(loc) {
+			continue
+		}
+		j := je.job()
+		t.identify(&j)
+		if t.outputKey(j).OutputName != j.outputName {
+			log.Printf("not restarting %q, which has been superseded", je.OutputName)
+			continue
+		}
+		log.Printf("restarting interrupted job %q", je.OutputName)
+		t.addJobWebhooks(j.outputName, je.Webhooks)
+		t.startJob(j, true)
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package transcoder
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func writeJournal(t *testing.T, dir string, j job) {
+	b, err := json.Marshal(journalEntry{OutputName: j.outputName, Input: j.input, Format: j.format})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, j.outputName+journalSuffix), b, 0640); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func dirNames(t *testing.T, dir string) (names []string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return
+}
+
+func TestRecoverCleansUp(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	interrupted := hangingJob(t)
+	failed := strings.Repeat("f", 32) + ".mp4"
+	writeJournal(t, tc.OutputDir, interrupted)
+	for _, name := range []string{
+		interrupted.outputName,
+		interrupted.outputName + ".input",
+		interrupted.outputName + ".log",
+		failed + ".input.part",
+		failed + ".log",
+		"notes.txt",
+	} {
+		qtc.Assert(os.WriteFile(filepath.Join(tc.OutputDir, name), nil, 0640), qt.IsNil)
+	}
+	qtc.Assert(tc.Recover(), qt.IsNil)
+	qtc.Check(dirNames(t, tc.OutputDir), qt.DeepEquals, []string{failed + ".log", "notes.txt"})
+	qtc.Check(tc.jobs, qt.HasLen, 0)
+}
+
+func TestRecoverRestartsJobs(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.RecoverJobs = true
+	})
+	// The input never downloads, so the job only gets anywhere by reusing the leftover input.
+	j := hangingJob(t)
+	writeJournal(t, tc.OutputDir, j)
+	qtc.Assert(os.WriteFile(filepath.Join(tc.OutputDir, j.outputName+".input"), nil, 0640), qt.IsNil)
+	qtc.Assert(tc.Recover(), qt.IsNil)
+	tc.mu.Lock()
+	rj := tc.jobs[j.outputName]
+	tc.mu.Unlock()
+	qtc.Assert(rj, qt.IsNotNil)
+	select {
+	case <-rj.done:
+	case <-time.After(5 * time.Second):
+		rj.cancel(errors.New("test over"))
+		<-rj.done
+		t.Fatal("job tried to download its input")
+	}
+	// There's no ffmpeg here, so the job fails after the download stage.
+	qtc.Check(rj.err, qt.Not(qt.ErrorMatches), ".*downloading.*")
+	qtc.Check(dirNames(t, tc.OutputDir), qt.Not(qt.Contains), j.outputName+journalSuffix)
+}
+
+func TestRecoverSkipsRedactedJobs(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.RecoverJobs = true
+	})
+	j := hangingJob(t)
+	b, err := json.Marshal(journalEntry{OutputName: j.outputName, Input: j.input, Format: j.format, Redacted: true})
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(os.WriteFile(tc.journalPath(j.outputName), b, 0640), qt.IsNil)
+	qtc.Assert(os.WriteFile(filepath.Join(tc.OutputDir, j.outputName+".input"), nil, 0640), qt.IsNil)
+	qtc.Assert(tc.Recover(), qt.IsNil)
+	qtc.Check(tc.jobs, qt.HasLen, 0)
+	qtc.Check(dirNames(t, tc.OutputDir), qt.HasLen, 0)
+}
+
+func TestJournalWrittenWhileRunning(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	input := hangingJob(t).input
+	j := jobFromQuery(url.Values{"i": {input + "?token=secret"}, "f": {"mp4"}})
+	rj := tc.startJob(j, false)
+	path := tc.journalPath(j.outputName)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b, err := os.ReadFile(path)
+	qtc.Assert(err, qt.IsNil)
+	var je journalEntry
+	qtc.Assert(json.Unmarshal(b, &je), qt.IsNil)
+	qtc.Check(je.OutputName, qt.Equals, j.outputName)
+	qtc.Check(je.Input, qt.Equals, input+"?REDACTED")
+	qtc.Check(je.Redacted, qt.IsTrue)
+	qtc.Check(je.Priority, qt.Equals, PriorityInteractive)
+	rj.cancel(errors.New("test over"))
+	<-rj.done
+	_, err = os.Stat(path)
+	qtc.Check(os.IsNotExist(err), qt.IsTrue)
+}
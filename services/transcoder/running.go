@@ -0,0 +1,306 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/anacrolix/log"
+	"github.com/anacrolix/missinggo/v2/resource"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// What happens to a job when the last request waiting on it goes away.
+type DisconnectPolicy string
+
+const (
+	// Cancel the job immediately. This is the default.
+	CancelUnwatched DisconnectPolicy = "cancel"
+	// Run the job to completion.
+	ContinueUnwatched DisconnectPolicy = "continue"
+	// Cancel the job if nobody starts waiting on it again within Transcoder.DisconnectGrace.
+	GraceUnwatched DisconnectPolicy = "grace"
+)
+
+// The cause of jobs cancelled by the DisconnectPolicy.
+var errUnwatched = errors.New("no longer wanted")
+
+type runningJob struct {
+	job  job
+	done chan struct{}
+	err  error
+	// Requests waiting on the job, and how many of them are from each client.
+	waiters       int
+	clientWaiters map[string]int
+	// Set for jobs that run to completion regardless of waiters.
+	detached bool
+	// Set once the job is cancelled for having no waiters. It can't be rejoined.
+	unwatched bool
+	cancel    context.CancelCauseFunc
+	grace     *time.Timer
+}
+
+func (rj *runningJob) cancelUnwatchedLocked() {
+	rj.unwatched = true
+	rj.cancel(errUnwatched)
+}
+
+func (rj *runningJob) stopGrace() {
+	if rj.grace != nil {
+		rj.grace.Stop()
+		rj.grace = nil
+	}
+}
+
+// Returns the running job for the output, starting it if necessary, or raising its priority if it's
+// queued. Detached jobs aren't cancelled when unwatched.
+func (t *Transcoder) startJob(j job, detached bool) *runningJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for {
+		rj := t.jobs[j.outputName]
+		if rj == nil || !rj.unwatched {
+			break
+		}
+		// The job is being cancelled, and its replacement would share its files.
+		t.mu.Unlock()
+		<-rj.done
+		t.mu.Lock()
+	}
+	if rj := t.jobs[j.outputName]; rj != nil {
+		t.sched.bump(j.outputName, j.priority)
+		if detached {
+			rj.detached = true
+			rj.stopGrace()
+		}
+		return rj
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	rj := &runningJob{
+		job:      j,
+		done:     make(chan struct{}),
+		detached: detached,
+		cancel:   cancel,
+	}
+	t.jobs[j.outputName] = rj
+	// Register the operation now so progress is available as soon as this returns.
+	op := t.newOperation()
+	t.operations[j.outputName] = op
+	go func() {
+		t.writeJournal(j)
+		err := t.transcode(ctx, j, op)
+		if err != nil {
+			log.Printf("error transcoding %q: %s", j.outputName, err)
+		}
+		os.Remove(t.journalPath(j.outputName))
+		cancel(nil)
+		t.mu.Lock()
+		rj.err = err
+		rj.stopGrace()
+		delete(t.jobs, j.outputName)
+		delete(t.operations, j.outputName)
+		t.mu.Unlock()
+		close(rj.done)
+	}()
+	return rj
+}
+
+// Runs the job given by the query, as in a request for the output, calling progress as it changes
+// until the output is stored. Cancelling ctx is like the request going away. For use outside the
+// HTTP server, such as from the command line.
+func (t *Transcoder) Run(ctx context.Context, q url.Values, progress func(Progress)) (outputName string, err error) {
+	j := t.newJob(q)
+	outputName = j.outputName
+	if err = j.invalid; err != nil {
+		return
+	}
+	if err = t.InputPolicy.check(j.input, t.TorrentClient != nil); err != nil {
+		return
+	}
+	outputLoc, err := t.RP.NewInstance(outputName)
+	if err != nil {
+		return
+	}
+	if resource.Exists(outputLoc) {
+		progress(Progress{Ready: true})
+		return
+	}
+	watchCtx, cancel := context.WithCancel(ctx)
+	watched := make(chan struct{})
+	var ready bool
+	go func() {
+		defer close(watched)
+		t.watchProgress(watchCtx, outputName, outputLoc, func(p Progress) bool {
+			ready = p.Ready
+			progress(p)
+			return true
+		})
+	}()
+	for {
+		err = t.waitJob(ctx, t.startJob(j, false), j.client)
+		// A job cancelled for being unwatched just as this joined it is started again.
+		if !errors.Is(err, errUnwatched) {
+			break
+		}
+	}
+	cancel()
+	<-watched
+	if err == nil && !ready {
+		progress(Progress{Ready: true})
+	}
+	return
+}
+
+// Waits for the job on behalf of the client, until it finishes or ctx is done, in which case the
+// DisconnectPolicy is applied if nobody else is waiting. Returns errUnwatched if the job was
+// cancelled for having no waiters before this could join it, in which case it should be started
+// again.
+func (t *Transcoder) waitJob(ctx context.Context, rj *runningJob, client string) error {
+	t.mu.Lock()
+	rj.waiters++
+	if rj.clientWaiters == nil {
+		rj.clientWaiters = make(map[string]int)
+	}
+	rj.clientWaiters[client]++
+	defer func() {
+		t.mu.Lock()
+		rj.clientWaiters[client]--
+		if rj.clientWaiters[client] == 0 {
+			delete(rj.clientWaiters, client)
+		}
+		t.mu.Unlock()
+	}()
+	rj.stopGrace()
+	t.waiting++
+	t.mu.Unlock()
+	t.metrics.waitingRequests.Inc()
+	defer t.metrics.waitingRequests.Dec()
+	select {
+	case <-rj.done:
+		t.mu.Lock()
+		rj.waiters--
+		t.waiting--
+		unwatched := rj.unwatched
+		t.mu.Unlock()
+		if unwatched && ctx.Err() == nil {
+			return errUnwatched
+		}
+		return rj.err
+	case <-ctx.Done():
+		t.mu.Lock()
+		rj.waiters--
+		t.waiting--
+		if rj.waiters == 0 {
+			t.jobUnwatchedLocked(rj)
+		}
+		t.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (t *Transcoder) jobUnwatchedLocked(rj *runningJob) {
+	if rj.detached {
+		return
+	}
+	switch t.DisconnectPolicy {
+	case ContinueUnwatched:
+	case GraceUnwatched:
+		rj.grace = time.AfterFunc(t.DisconnectGrace, func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if rj.waiters == 0 && !rj.detached {
+				rj.cancelUnwatchedLocked()
+			}
+		})
+	default:
+		rj.cancelUnwatchedLocked()
+	}
+}
+
+// A running job, as listed by GET /jobs.
+type JobStatus = api.JobStatus
+
+// The running jobs, oldest first. Credentials in inputs are redacted.
+func (t *Transcoder) runningJobs() (ret []JobStatus) {
+	var ops []*operation
+	t.mu.Lock()
+	ret = make([]JobStatus, 0, len(t.jobs))
+	for name, rj := range t.jobs {
+		ret = append(ret, JobStatus{
+			OutputName: name,
+			Input:      redactInput(rj.job.input, rj.job.input),
+			InputPath:  rj.job.inputPath,
+			Format:     rj.job.format,
+			Priority:   rj.job.priority,
+			Client:     rj.job.client,
+			Detached:   rj.detached,
+			Waiters:    rj.waiters,
+		})
+		ops = append(ops, t.operations[name])
+	}
+	t.mu.Unlock()
+	for i, op := range ops {
+		if op == nil {
+			// The job is finishing.
+			continue
+		}
+		op.mu.Lock()
+		ret[i].Started = op.started
+		ret[i].Progress = op.Progress
+		op.mu.Unlock()
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Started.Before(ret[j].Started)
+	})
+	return
+}
+
+func (t *Transcoder) serveJobs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t.runningJobs())
+}
+
+// Returned by job submission.
+type JobRef = api.JobRef
+
+func newJobRef(outputName, rawQuery string) JobRef {
+	return JobRef{
+		OutputName: outputName,
+		URL:        "/?" + rawQuery,
+		EventsURL:  "/events?" + rawQuery,
+	}
+}
+
+// Starts a job that runs to completion without anyone waiting on it, at batch priority unless
+// specified. Responds with 202 and the job's URLs, or 200 if the output is already available.
+func (t *Transcoder) serveSubmit(w http.ResponseWriter, r *http.Request, j job, outputLoc resource.Instance) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ref := newJobRef(j.outputName, r.URL.RawQuery)
+	status := http.StatusOK
+	if !resource.Exists(outputLoc) {
+		if retryAfter, shed := t.shouldShed(j, false); shed {
+			t.serveShed(w, retryAfter)
+			return
+		}
+		if r.URL.Query().Get("priority") == "" {
+			j.priority = PriorityBatch
+		}
+		t.addJobWebhooks(j.outputName, j.webhooks)
+		t.startJob(j, true)
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", ref.URL)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ref)
+}
@@ -0,0 +1,198 @@
+package transcoder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/missinggo/v2/filecache"
+	qt "github.com/frankban/quicktest"
+)
+
+// Returns a job whose input download never completes.
+func hangingJob(t *testing.T) job {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	t.Cleanup(srv.Close)
+	return jobFromQuery(url.Values{"i": {srv.URL + "/input.avi"}, "f": {"mp4"}})
+}
+
+func newTestTranscoder(t *testing.T, configure ...func(*Transcoder)) *Transcoder {
+	fc, err := filecache.NewCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc := &Transcoder{
+		RP:        fc.AsResourceProvider(),
+		OutputDir: t.TempDir(),
+	}
+	for _, f := range configure {
+		f(tc)
+	}
+	tc.Init()
+	return tc
+}
+
+func isDone(rj *runningJob, within time.Duration) bool {
+	select {
+	case <-rj.done:
+		return true
+	case <-time.After(within):
+		return false
+	}
+}
+
+func leaveJob(t *testing.T, tc *Transcoder, rj *runningJob) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+	if err := tc.waitJob(ctx, rj, ""); err != context.Canceled {
+		t.Fatalf("unexpected error waiting on job: %v", err)
+	}
+}
+
+func TestDisconnectPolicy(t *testing.T) {
+	qtc := qt.New(t)
+
+	tc := newTestTranscoder(t)
+	rj := tc.startJob(hangingJob(t), false)
+	leaveJob(t, tc, rj)
+	qtc.Assert(isDone(rj, 5*time.Second), qt.IsTrue)
+	qtc.Check(errors.Is(rj.err, errUnwatched), qt.IsTrue, qt.Commentf("%v", rj.err))
+
+	tc = newTestTranscoder(t)
+	tc.DisconnectPolicy = ContinueUnwatched
+	rj = tc.startJob(hangingJob(t), false)
+	leaveJob(t, tc, rj)
+	qtc.Check(isDone(rj, 100*time.Millisecond), qt.IsFalse)
+	rj.cancel(errors.New("test over"))
+	qtc.Check(isDone(rj, 5*time.Second), qt.IsTrue)
+
+	tc = newTestTranscoder(t)
+	tc.DisconnectPolicy = GraceUnwatched
+	tc.DisconnectGrace = 200 * time.Millisecond
+	j := hangingJob(t)
+	rj = tc.startJob(j, false)
+	leaveJob(t, tc, rj)
+	qtc.Check(isDone(rj, 50*time.Millisecond), qt.IsFalse)
+	// A new viewer within the grace period attaches to the same job and stops the timer.
+	qtc.Check(tc.startJob(j, false), qt.Equals, rj)
+	leaveJob(t, tc, rj)
+	qtc.Check(isDone(rj, 100*time.Millisecond), qt.IsFalse)
+	qtc.Check(isDone(rj, 5*time.Second), qt.IsTrue)
+}
+
+// Viewers arriving as an unwatched job is cancelled get a new job rather than its error.
+func TestRejoinCancelledJob(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	j := hangingJob(t)
+	rj := tc.startJob(j, false)
+	tc.mu.Lock()
+	rj.cancelUnwatchedLocked()
+	tc.mu.Unlock()
+	qtc.Check(tc.waitJob(context.Background(), rj, ""), qt.Equals, errUnwatched)
+	rj2 := tc.startJob(j, false)
+	qtc.Check(rj2, qt.Not(qt.Equals), rj)
+	qtc.Check(isDone(rj2, 50*time.Millisecond), qt.IsFalse)
+	rj2.cancel(errors.New("test over"))
+	qtc.Check(isDone(rj2, 5*time.Second), qt.IsTrue)
+}
+
+func TestSubmitJob(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	j := hangingJob(t)
+	q := url.Values{"i": {j.input}, "f": {j.format}}
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/jobs?"+q.Encode(), nil))
+	qtc.Assert(w.Code, qt.Equals, http.StatusAccepted)
+	var ref JobRef
+	qtc.Assert(json.NewDecoder(w.Body).Decode(&ref), qt.IsNil)
+	qtc.Check(ref.OutputName, qt.Equals, j.outputName)
+	qtc.Check(w.Header().Get("Location"), qt.Equals, ref.URL)
+	tc.mu.Lock()
+	rj := tc.jobs[j.outputName]
+	tc.mu.Unlock()
+	qtc.Assert(rj, qt.IsNotNil)
+	// Submitted jobs survive their viewers leaving.
+	leaveJob(t, tc, rj)
+	qtc.Check(isDone(rj, 100*time.Millisecond), qt.IsFalse)
+	rj.cancel(errors.New("test over"))
+	<-rj.done
+
+	w = httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs?"+q.Encode(), nil))
+	qtc.Check(w.Code, qt.Equals, http.StatusMethodNotAllowed)
+}
+
+func TestListJobs(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	list := func() (jobs []JobStatus) {
+		w := httptest.NewRecorder()
+		tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/jobs", nil))
+		qtc.Assert(w.Code, qt.Equals, http.StatusOK)
+		qtc.Assert(json.NewDecoder(w.Body).Decode(&jobs), qt.IsNil)
+		return
+	}
+	qtc.Check(list(), qt.HasLen, 0)
+	input := hangingJob(t).input
+	j := jobFromQuery(url.Values{"i": {input + "?token=secret"}, "f": {"mp4"}})
+	j.client = "tester"
+	rj := tc.startJob(j, true)
+	jobs := list()
+	qtc.Assert(jobs, qt.HasLen, 1)
+	qtc.Check(jobs[0].OutputName, qt.Equals, j.outputName)
+	qtc.Check(jobs[0].Input, qt.Equals, input+"?REDACTED")
+	qtc.Check(jobs[0].Client, qt.Equals, "tester")
+	qtc.Check(jobs[0].Detached, qt.IsTrue)
+	qtc.Check(jobs[0].Started.IsZero(), qt.IsFalse)
+	rj.cancel(errors.New("test over"))
+	<-rj.done
+	qtc.Check(list(), qt.HasLen, 0)
+}
+
+func TestRun(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	j := hangingJob(t)
+	q := url.Values{"i": {j.input}, "f": {j.format}}
+	ctx, cancel := context.WithCancel(context.Background())
+	downloading := make(chan struct{})
+	var once sync.Once
+	go func() {
+		<-downloading
+		cancel()
+	}()
+	name, err := tc.Run(ctx, q, func(p Progress) {
+		if p.Downloading {
+			once.Do(func() { close(downloading) })
+		}
+	})
+	qtc.Check(name, qt.Equals, j.outputName)
+	qtc.Check(err, qt.Equals, context.Canceled)
+
+	// Stored outputs are ready immediately.
+	loc, err := tc.RP.NewInstance(j.outputName)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(loc.Put(strings.NewReader("output")), qt.IsNil)
+	var ready bool
+	_, err = tc.Run(context.Background(), q, func(p Progress) {
+		ready = p.Ready
+	})
+	qtc.Check(err, qt.IsNil)
+	qtc.Check(ready, qt.IsTrue)
+}
@@ -0,0 +1,180 @@
+package transcoder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/webtorrent-public/services/transcoder/api"
+)
+
+// Determines the order in which queued jobs run.
+type Priority = api.Priority
+
+const (
+	PriorityInteractive = api.PriorityInteractive
+	PriorityPrefetch    = api.PriorityPrefetch
+	PriorityBatch       = api.PriorityBatch
+)
+
+func priorityRank(p Priority) int {
+	switch p {
+	case PriorityBatch:
+		return 0
+	case PriorityPrefetch:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func parsePriority(s string, def Priority) Priority {
+	switch p := Priority(s); p {
+	case PriorityInteractive, PriorityPrefetch, PriorityBatch:
+		return p
+	default:
+		return def
+	}
+}
+
+// Identifies who a request is from for fairness: by ClientHeader if it's set, then the client query
+// parameter if it's trusted, and otherwise the remote host. Requests can't choose their own identity
+// by default, or they could take turns from others.
+func (t *Transcoder) requestClient(r *http.Request) string {
+	if t.ClientHeader != "" {
+		// The first of a list such as X-Forwarded-For is the original client.
+		c, _, _ := strings.Cut(r.Header.Get(t.ClientHeader), ",")
+		if c = strings.TrimSpace(c); c != "" {
+			return c
+		}
+	}
+	if t.TrustClientParam {
+		if c := r.URL.Query().Get("client"); c != "" {
+			return c
+		}
+	}
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	return host
+}
+
+type queuedJob struct {
+	outputName string
+	priority   Priority
+	client     string
+	ready      chan struct{}
+}
+
+// Limits the number of concurrent jobs. Queued jobs run in priority order, and round-robin across
+// clients within a priority.
+type scheduler struct {
+	mu sync.Mutex
+	// Zero means no limit.
+	max     int
+	running int
+	queue   []*queuedJob
+	// The turn on which each client last had a job started.
+	served map[string]uint64
+	turn   uint64
+}
+
+// Waits for a slot to run the job in. onQueued is called if the job has to wait.
+func (s *scheduler) acquire(
+	ctx context.Context,
+	outputName string,
+	priority Priority,
+	client string,
+	onQueued func(),
+) (release func(), err error) {
+	s.mu.Lock()
+	if s.max == 0 || s.running < s.max && len(s.queue) == 0 {
+		s.startLocked(client)
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	qj := &queuedJob{
+		outputName: outputName,
+		priority:   priority,
+		client:     client,
+		ready:      make(chan struct{}),
+	}
+	s.queue = append(s.queue, qj)
+	s.mu.Unlock()
+	onQueued()
+	select {
+	case <-qj.ready:
+		return s.release, nil
+	case <-ctx.Done():
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, e := range s.queue {
+		if e == qj {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return nil, context.Cause(ctx)
+		}
+	}
+	// The slot was granted as we gave up on it.
+	s.running--
+	s.dispatchLocked()
+	return nil, context.Cause(ctx)
+}
+
+func (s *scheduler) startLocked(client string) {
+	if s.served == nil {
+		s.served = make(map[string]uint64)
+	}
+	s.turn++
+	s.served[client] = s.turn
+	s.running++
+}
+
+func (s *scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	s.dispatchLocked()
+}
+
+func (s *scheduler) dispatchLocked() {
+	for len(s.queue) != 0 && (s.max == 0 || s.running < s.max) {
+		best := 0
+		for i, qj := range s.queue[1:] {
+			if s.before(qj, s.queue[best]) {
+				best = i + 1
+			}
+		}
+		qj := s.queue[best]
+		s.queue = append(s.queue[:best], s.queue[best+1:]...)
+		s.startLocked(qj.client)
+		close(qj.ready)
+	}
+	if len(s.queue) == 0 && s.running == 0 {
+		// Nobody is competing, so forget who was served.
+		s.served = nil
+	}
+}
+
+// Whether a should run before b, given a is later in the queue.
+func (s *scheduler) before(a, b *queuedJob) bool {
+	if priorityRank(a.priority) != priorityRank(b.priority) {
+		return priorityRank(a.priority) > priorityRank(b.priority)
+	}
+	return s.served[a.client] < s.served[b.client]
+}
+
+// Raises the priority of a queued job. Returns false if the job isn't queued.
+func (s *scheduler) bump(outputName string, priority Priority) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, qj := range s.queue {
+		if qj.outputName == outputName {
+			if priorityRank(priority) > priorityRank(qj.priority) {
+				qj.priority = priority
+			}
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package transcoder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// Queues jobs behind a running one, then releases them one at a time, returning the order they
+// ran in.
+func runQueued(t *testing.T, s *scheduler, jobs []queuedJob, beforeRelease func()) (order []string) {
+	release, err := s.acquire(context.Background(), "first", PriorityInteractive, "a", nil)
+	qt.Assert(t, err, qt.IsNil)
+	started := make(chan string)
+	var wg sync.WaitGroup
+	for _, qj := range jobs {
+		qj := qj
+		queued := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := s.acquire(context.Background(), qj.outputName, qj.priority, qj.client, func() {
+				close(queued)
+			})
+			if err != nil {
+				panic(err)
+			}
+			started <- qj.outputName
+			release()
+		}()
+		<-queued
+	}
+	if beforeRelease != nil {
+		beforeRelease()
+	}
+	release()
+	for range jobs {
+		order = append(order, <-started)
+	}
+	wg.Wait()
+	return
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := scheduler{max: 1}
+	order := runQueued(t, &s, []queuedJob{
+		{outputName: "a1", priority: PriorityBatch, client: "a"},
+		{outputName: "a2", priority: PriorityBatch, client: "a"},
+		{outputName: "b1", priority: PriorityBatch, client: "b"},
+		{outputName: "a3", priority: PriorityPrefetch, client: "a"},
+		{outputName: "c1", priority: PriorityInteractive, client: "c"},
+	}, nil)
+	qt.Check(t, order, qt.DeepEquals, []string{"c1", "a3", "b1", "a1", "a2"})
+	qt.Check(t, s.running, qt.Equals, 0)
+	qt.Check(t, s.served, qt.IsNil)
+}
+
+func TestSchedulerBump(t *testing.T) {
+	s := scheduler{max: 1}
+	order := runQueued(t, &s, []queuedJob{
+		{outputName: "x", priority: PriorityBatch, client: "a"},
+		{outputName: "y", priority: PriorityBatch, client: "a"},
+	}, func() {
+		qt.Check(t, s.bump("y", PriorityInteractive), qt.IsTrue)
+		qt.Check(t, s.bump("z", PriorityInteractive), qt.IsFalse)
+	})
+	qt.Check(t, order, qt.DeepEquals, []string{"y", "x"})
+}
+
+func TestSchedulerCancelQueued(t *testing.T) {
+	s := scheduler{max: 1}
+	release, err := s.acquire(context.Background(), "first", PriorityInteractive, "a", nil)
+	qt.Assert(t, err, qt.IsNil)
+	ctx, cancel := context.WithCancel(context.Background())
+	_, err = s.acquire(ctx, "second", PriorityInteractive, "b", cancel)
+	qt.Check(t, err, qt.Equals, context.Canceled)
+	qt.Check(t, s.queue, qt.HasLen, 0)
+	release()
+	qt.Check(t, s.running, qt.Equals, 0)
+}
+
+func TestRequestClient(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/?client=someone-else", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.7, 192.0.2.1")
+	var tc Transcoder
+	qt.Check(t, tc.requestClient(r), qt.Equals, "192.0.2.1")
+	tc.TrustClientParam = true
+	qt.Check(t, tc.requestClient(r), qt.Equals, "someone-else")
+	tc.ClientHeader = "X-Forwarded-For"
+	qt.Check(t, tc.requestClient(r), qt.Equals, "198.51.100.7")
+	r.Header.Del("X-Forwarded-For")
+	tc.TrustClientParam = false
+	qt.Check(t, tc.requestClient(r), qt.Equals, "192.0.2.1")
+}
@@ -0,0 +1,69 @@
+package transcoder
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// How many recent job durations Retry-After estimates are based on.
+const recentJobDurationsSize = 20
+
+// Assumed job duration before any jobs have completed.
+var defaultJobDuration = time.Minute
+
+// Records how long a completed job ran for, excluding time spent queued.
+func (t *Transcoder) recordJobDuration(res JobResult) {
+	if res.State != JobCompleted {
+		return
+	}
+	started := res.Started
+	if q := res.Stages["queue"]; !q.Finished.IsZero() {
+		started = q.Finished
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.recentJobDurations = append(t.recentJobDurations, res.Finished.Sub(started))
+	if len(t.recentJobDurations) > recentJobDurationsSize {
+		t.recentJobDurations = t.recentJobDurations[1:]
+	}
+}
+
+// Returns whether a request for the job should be rejected, and when the client should retry.
+// Requests for jobs that are already running are only rejected if too many requests are waiting.
+func (t *Transcoder) shouldShed(j job, waiting bool) (retryAfter time.Duration, shed bool) {
+	queued := t.queuedJobs()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case waiting && t.MaxWaiting != 0 && t.waiting >= t.MaxWaiting:
+	case t.jobs[j.outputName] == nil && t.MaxQueued != 0 && queued >= t.MaxQueued:
+	default:
+		return
+	}
+	avg := defaultJobDuration
+	if n := len(t.recentJobDurations); n != 0 {
+		var sum time.Duration
+		for _, d := range t.recentJobDurations {
+			sum += d
+		}
+		avg = sum / time.Duration(n)
+	}
+	slots := t.MaxJobs
+	if slots == 0 {
+		slots = 1
+	}
+	// Jobs ahead of this one, including the one that would have to finish to make room.
+	rounds := (queued + slots) / slots
+	return time.Duration(rounds) * avg, true
+}
+
+func (t *Transcoder) serveShed(w http.ResponseWriter, retryAfter time.Duration) {
+	t.metrics.shedRequests.Inc()
+	secs := int64((retryAfter + time.Second - 1) / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	http.Error(w, "transcoder is busy", http.StatusServiceUnavailable)
+}
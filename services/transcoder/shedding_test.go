@@ -0,0 +1,62 @@
+package transcoder
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestShedding(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t, func(tc *Transcoder) {
+		tc.MaxJobs = 1
+		tc.MaxQueued = 1
+	})
+	for range [2]struct{}{} {
+		rj := tc.startJob(hangingJob(t), false)
+		t.Cleanup(func() {
+			rj.cancel(errors.New("test over"))
+			<-rj.done
+		})
+	}
+	for tc.queuedJobs() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	get := func(j job) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		q := url.Values{"i": {j.input}, "f": {j.format}}
+		tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil))
+		return w
+	}
+	w := get(hangingJob(t))
+	qtc.Check(w.Code, qt.Equals, http.StatusServiceUnavailable)
+	qtc.Check(w.Header().Get("Retry-After"), qt.Equals, "120")
+
+	// Cache hits are unaffected.
+	cached := hangingJob(t)
+	loc, err := tc.RP.NewInstance(cached.outputName)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(loc.Put(strings.NewReader("output")), qt.IsNil)
+	w = get(cached)
+	qtc.Check(w.Code, qt.Equals, http.StatusOK)
+	qtc.Check(w.Body.String(), qt.Equals, "output")
+
+	tc.MaxWaiting = 1
+	tc.mu.Lock()
+	tc.waiting = 1
+	tc.recentJobDurations = []time.Duration{time.Second, 3 * time.Second}
+	tc.mu.Unlock()
+	tc.MaxQueued = 0
+	retryAfter, shed := tc.shouldShed(hangingJob(t), true)
+	qtc.Check(shed, qt.IsTrue)
+	qtc.Check(retryAfter, qt.Equals, 4*time.Second)
+	_, shed = tc.shouldShed(hangingJob(t), false)
+	qtc.Check(shed, qt.IsFalse)
+}
@@ -0,0 +1,118 @@
+package transcoder
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/prometheus/client_golang/prometheus"
+
+	wtpub "github.com/anacrolix/webtorrent-public"
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
+
+// Readahead for torrent readers serving ffmpeg. Containers are mostly read sequentially, but
+// seeking to indexes at the end of a file is common.
+const torrentInputReadahead = 8 << 20
+
+// Opens the file in a torrent for an input. inputPath is the file's display path within the
+// torrent. release must be called once the input has been read.
+func (t *Transcoder) openTorrentInput(ctx context.Context, ref, inputPath string) (f *torrent.File, release func(), err error) {
+	tor, release, err := torrents.Add(ctx, t.TorrentClient, ref)
+	if err != nil {
+		return
+	}
+	f, err = torrents.File(tor, inputPath)
+	if err != nil {
+		release()
+	}
+	return
+}
+
+// The URL ffmpeg reads a torrent input from. It's served from the progress listener.
+func (t *Transcoder) torrentInputURL(outputName string) string {
+	return (&url.URL{
+		Scheme: "http",
+		Host:   t.progressListener.Addr().String(),
+		Path:   "/input",
+		RawQuery: (url.Values{
+			"id": {outputName},
+		}).Encode(),
+	}).String()
+}
+
+// Counts the bytes ffmpeg reads from a torrent.
+type countingReader struct {
+	wtpub.ContextReader
+	bytesRead prometheus.Counter
+}
+
+func (me countingReader) Read(b []byte) (int, error) {
+	n, err := me.ContextReader.Read(b)
+	me.bytesRead.Add(float64(n))
+	return n, err
+}
+
+// Serves an operation's torrent file to ffmpeg. Each request gets its own reader, so the pieces
+// ffmpeg is reading and about to read are prioritized.
+func (t *Transcoder) serveTorrentInput(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	t.mu.Lock()
+	op := t.operations[id]
+	t.mu.Unlock()
+	if op == nil {
+		http.NotFound(w, r)
+		return
+	}
+	op.mu.Lock()
+	f := op.torrentFile
+	op.mu.Unlock()
+	if f == nil {
+		http.NotFound(w, r)
+		return
+	}
+	tr := f.NewReader()
+	defer tr.Close()
+	tr.SetReadahead(torrentInputReadahead)
+	tr.SetResponsive()
+	http.ServeContent(w, r, path.Base(f.DisplayPath()), time.Time{}, countingReader{
+		wtpub.ContextReader{Ctx: r.Context(), R: tr},
+		t.metrics.downloadBytes.WithLabelValues("torrent"),
+	})
+}
+
+// Updates download progress from the state of the file's pieces until it's complete or the
+// context is done.
+func trackTorrentFileProgress(ctx context.Context, f *torrent.File, updateProgress func(func(*Progress))) {
+	for {
+		var pieces, complete int
+		for _, ps := range f.State() {
+			pieces++
+			if ps.Complete {
+				complete++
+			}
+		}
+		done := complete == pieces
+		updateProgress(func(p *Progress) {
+			p.Downloading = !done
+			p.Pieces = pieces
+			p.PiecesComplete = complete
+			if f.Length() != 0 {
+				p.DownloadProgress = float64(f.BytesCompleted()) / float64(f.Length())
+			} else {
+				p.DownloadProgress = 1
+			}
+		})
+		if done {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
@@ -2,42 +2,32 @@ package transcoder
 
 import (
 	"context"
-	"crypto/md5"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/anacrolix/log"
 	"github.com/anacrolix/missinggo/v2/pubsub"
 	"github.com/anacrolix/missinggo/v2/resource"
+	"github.com/anacrolix/torrent"
 	"github.com/dustin/go-humanize"
 	"nhooyr.io/websocket"
 	"nhooyr.io/websocket/wsjson"
-	"resenje.org/singleflight"
-)
-
-var hashStringsSize = md5.Size
 
-// 54228
-func hashStrings(ss []string) []byte {
-	h := md5.New()
-	var b []byte
-	for _, s := range ss {
-		b = h.Sum(b[:0])
-		h.Write(b)
-		h.Write([]byte(s))
-	}
-	return h.Sum(b[:0])
-}
+	wtpub "github.com/anacrolix/webtorrent-public"
+	"github.com/anacrolix/webtorrent-public/torrents"
+)
 
-func (t *Transcoder) cacheFile(name string, progress func(f float64)) (err error) {
+func (t *Transcoder) cacheFile(ctx context.Context, name string, progress func(f float64)) (err error) {
 	dstLoc, err := t.RP.NewInstance(filepath.Base(name))
 	if err != nil {
 		return
@@ -51,31 +41,22 @@ func (t *Transcoder) cacheFile(name string, progress func(f float64)) (err error
 	pw.callback = progress
 	pw.total, _ = srcFile.Seek(0, io.SeekEnd)
 	srcFile.Seek(0, io.SeekStart)
-	return dstLoc.Put(io.TeeReader(srcFile, &pw))
-}
-
-func reencodeURL(s string) string {
-	url_, err := url.Parse(s)
-	if err != nil || url_.Scheme == "" {
-		// Why?
-		return s
-	}
-	url_.RawQuery = url_.Query().Encode()
-	return url_.String()
+	return dstLoc.Put(io.TeeReader(wtpub.ContextReader{Ctx: ctx, R: srcFile}, &pw))
 }
 
 func ffmpegArgs(
-	tempFilePath, progressListenerUrl, outputName, outputFilePath string,
+	ffmpeg, input, progressListenerUrl, outputName, outputFilePath string,
 	outputOpts, inputOpts []string,
-) (ret []string) {
-	_, err := exec.LookPath("nice")
-	if err == nil {
-		// Windows does not have nice (things lol).
-		ret = append(ret, "nice")
-	}
-	ret = append(ret, "ffmpeg", "-hide_banner")
+	limits ResourceLimits,
+) (ret []string, applied ResourceLimits) {
+	ret, applied = limits.wrapperArgs()
+	ret = append(ret, ffmpeg, "-hide_banner")
 	ret = append(ret, inputOpts...)
-	ret = append(ret, "-i", tempFilePath)
+	ret = append(ret, "-i", input)
+	if limits.Threads != 0 {
+		// Before the output options so they can override it.
+		ret = append(ret, "-threads", strconv.Itoa(limits.Threads))
+	}
 	ret = append(ret, outputOpts...)
 	ret = append(ret,
 		"-progress", (&url.URL{
@@ -90,44 +71,136 @@ func ffmpegArgs(
 	return
 }
 
-func (t *Transcoder) transcode(
-	ctx context.Context,
-	outputName,
-	inputURL string,
-	opts, iopts []string,
-) (err error) {
-	op := &operation{
-		sendEvent: func() { t.events.Publish(struct{}{}) },
-	}
+func (t *Transcoder) newOperation() *operation {
+	return newOperation(func() { t.events.Publish(struct{}{}) })
+}
+
+// Runs the job, reporting its progress through op.
+func (t *Transcoder) transcode(ctx context.Context, j job, op *operation) (err error) {
+	outputName := j.outputName
 	defer op.sendEvent()
-	t.mu.Lock()
-	// The operation needs to be visible for progress operations?
-	t.operations[outputName] = op
-	t.mu.Unlock()
+	t.metrics.jobsStarted.Inc()
 	defer func() {
-		t.mu.Lock()
-		delete(t.operations, outputName)
-		t.mu.Unlock()
+		t.jobFinished(t.jobResult(j, op, err, ctx.Err() != nil))
 	}()
+	// ctx is cancelled when nobody wants the job anymore. jobCtx is also cancelled by the
+	// watchdog.
+	jobCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go t.watchOperation(jobCtx, outputName, op, cancel)
+	defer func() {
+		if err != nil && ctx.Err() == nil && errors.Is(context.Cause(jobCtx), ErrTimeout) {
+			err = context.Cause(jobCtx)
+		}
+	}()
+	release, err := t.sched.acquire(jobCtx, outputName, j.priority, j.client, func() {
+		op.updateProgress(func(p *Progress) {
+			p.Queued = true
+		})
+	})
+	op.updateProgress(func(p *Progress) {
+		p.Queued = false
+	})
+	if err != nil {
+		return
+	}
+	defer release()
 	outputFilePath := filepath.Join(t.OutputDir, outputName)
 	defer os.Remove(outputFilePath)
 
-	tempFilePath := outputFilePath + ".input"
 	outputLogFilePath := outputFilePath + ".log"
-	err = transcode(
-		ctx,
-		inputURL,
-		tempFilePath,
-		outputLogFilePath,
-		outputName,
-		ffmpegArgs(
-			tempFilePath,
+	var (
+		input    string
+		download func(context.Context, func(float64)) error
+	)
+	if t.TorrentClient != nil && torrents.IsRef(j.input) {
+		var (
+			f              *torrent.File
+			releaseTorrent func()
+		)
+		f, releaseTorrent, err = t.openTorrentInput(jobCtx, j.input, j.inputPath)
+		if err != nil {
+			return fmt.Errorf("opening torrent input %q: %w", j.input, err)
+		}
+		defer releaseTorrent()
+		op.mu.Lock()
+		op.torrentFile = f
+		op.mu.Unlock()
+		go trackTorrentFileProgress(jobCtx, f, op.updateProgress)
+		input = t.torrentInputURL(outputName)
+	} else if j.clip.IsSet() && t.rangeReadable(jobCtx, j.input) {
+		// ffmpeg seeks with range requests, so only the clip and the index are fetched.
+		input = j.input
+	} else {
+		input = outputFilePath + ".input"
+		defer os.Remove(input)
+		download = func(ctx context.Context, progress func(float64)) error {
+			err := downloadInput(ctx, j.input, input, progress)
+			if fi, err := os.Stat(input); err == nil {
+				t.metrics.downloadBytes.WithLabelValues("http").Add(float64(fi.Size()))
+			}
+			if err != nil {
+				err = fmt.Errorf("error downloading %q: %w", j.input, err)
+			}
+			return err
+		}
+		if _, err := os.Stat(input); err == nil {
+			// Kept from an interrupted job by Recover.
+			log.Printf("reusing downloaded input for %q", outputName)
+			download = nil
+		}
+	}
+	inputOpts := append(j.clip.inputOptions(j.clip.keyframeSeek(j.opts)), j.iopts...)
+	buildArgs := func(outputOpts []string, outputFilePath string) ([]string, ResourceLimits) {
+		return ffmpegArgs(
+			t.ffmpegPath(),
+			input,
 			t.progressListener.Addr().String(),
 			outputName,
 			outputFilePath,
-			opts,
-			iopts,
-		),
+			append(j.clip.outputOptions(), outputOpts...),
+			inputOpts,
+			t.Limits,
+		)
+	}
+	args, appliedLimits := buildArgs(j.opts, outputFilePath)
+	cgroup, err := t.Limits.createCgroup(outputName)
+	if err != nil {
+		log.Levelf(log.Warning, "error creating cgroup for %q: %v", outputName, err)
+	} else if cgroup != "" {
+		defer os.Remove(cgroup)
+		appliedLimits.Cgroup = cgroup
+		appliedLimits.CgroupCPUs = t.Limits.CgroupCPUs
+		appliedLimits.CgroupMemory = t.Limits.CgroupMemory
+	}
+	op.mu.Lock()
+	op.limits = appliedLimits
+	op.mu.Unlock()
+	prepare := func(context.Context) ([]string, error) { return args, nil }
+	if j.audio != nil {
+		// Audio jobs depend on the input's streams.
+		prepare = func(ctx context.Context) ([]string, error) {
+			opts, err := t.audioOptions(ctx, j, input, func(ctx context.Context, opts []string) ([]byte, error) {
+				args, _ := buildArgs(opts, "-")
+				return runAnalysis(ctx, input, args, cgroup)
+			}, op.updateProgress)
+			if err != nil {
+				return nil, err
+			}
+			args, _ := buildArgs(append(opts, j.opts...), outputFilePath)
+			return args, nil
+		}
+	}
+	err = transcode(
+		jobCtx,
+		input,
+		outputLogFilePath,
+		outputName,
+		download,
+		t.FFprobePath,
+		j.clip,
+		prepare,
+		cgroup,
 		op.updateProgress,
 	)
 	if err != nil {
@@ -144,17 +217,23 @@ func (t *Transcoder) transcode(
 		if err != nil {
 			return err.Error()
 		}
+		op.mu.Lock()
+		op.outputSize = fi.Size()
+		op.mu.Unlock()
 		return humanize.Bytes(uint64(fi.Size()))
 	}())
 	started := time.Now()
-	go t.cacheFile(outputLogFilePath, func(float64) {})
+	if err := redactLogFile(outputLogFilePath, j.input); err != nil {
+		log.Levelf(log.Warning, "error redacting log for %q: %v", outputName, err)
+	}
+	go t.cacheFile(context.Background(), outputLogFilePath, func(float64) {})
 	op.updateProgress(func(p *Progress) {
 		p.Storing = true
 	})
 	defer op.updateProgress(func(p *Progress) {
 		p.Storing = false
 	})
-	err = t.cacheFile(outputFilePath, func(f float64) {
+	err = t.cacheFile(jobCtx, outputFilePath, func(f float64) {
 		op.updateProgress(func(p *Progress) {
 			p.StoreProgress.Set(f)
 		})
@@ -162,24 +241,109 @@ func (t *Transcoder) transcode(
 	if err != nil {
 		return
 	}
+	t.storeOutputKey(j)
 	log.Printf("stored files for %s in %s", outputName, time.Since(started))
 	return
 }
 
 type Transcoder struct {
-	sf singleflight.Group[string, struct{}]
 	RP resource.Provider
+	// Used to stream inputs given as magnet URIs or infohashes. If nil, all inputs are fetched
+	// over HTTP.
+	TorrentClient *torrent.Client
 	// Where ffmpeg creates files.
-	OutputDir        string
-	progressListener net.Listener
-	progressHandler  progressHandler
-	mu               sync.Mutex
-	operations       map[string]*operation
-	events           pubsub.PubSub[struct{}]
+	OutputDir string
+	// URLs that are sent the JobResult of every job.
+	Webhooks []string
+	// Host patterns, matched with path.Match, of URLs that requests can add as webhooks with the
+	// webhook query parameter. Empty refuses requests that give webhooks.
+	WebhookHosts []string
+	// If set, webhook payloads are signed with HMAC-SHA256 in WebhookSignatureHeader.
+	WebhookSecret string
+	// Where finished jobs are recorded, if set.
+	History *History
+	// Jobs whose progress doesn't change for this long are killed. Zero disables.
+	StallTimeout time.Duration
+	// Limits on the duration of job stages, keyed by the stage names in StageTimes. Torrent inputs
+	// are streamed while they're converted, so for them the download limit is on time without
+	// download progress.
+	StageTimeouts map[string]time.Duration
+	// Applied to the ffmpeg process of every job.
+	Limits ResourceLimits
+	// What to do with a job when all requests waiting on it go away. Jobs submitted to /jobs
+	// always run to completion.
+	DisconnectPolicy DisconnectPolicy
+	// How long unwatched jobs continue for with the GraceUnwatched policy.
+	DisconnectGrace time.Duration
+	// The maximum number of jobs that run at once. Others are queued by priority, and round-robin
+	// across clients. Zero means no limit.
+	MaxJobs int
+	// A request header identifying the client for scheduling, set by a trusted proxy, such as one
+	// holding an authenticated user, or X-Forwarded-For. Requests without it fall back to the
+	// remote address.
+	ClientHeader string
+	// Identify clients by the client query parameter, which requests set themselves. Only for
+	// servers whose requesters are trusted.
+	TrustClientParam bool
+	// Cache misses that would queue a new job are rejected with 503 when this many jobs are already
+	// queued. Zero means no limit.
+	MaxQueued int
+	// Cache misses are rejected with 503 when this many requests are already waiting on jobs. Zero
+	// means no limit.
+	MaxWaiting int
+	// Origins allowed to make cross-origin requests, including for event websockets. Patterns are
+	// matched with path.Match, such as "https://*.example.com", and "*" allows any origin.
+	AllowedOrigins []string
+	// The ffmpeg and ffprobe executables. Empty means look them up in PATH.
+	FFmpegPath  string
+	FFprobePath string
+	// Restricts the inputs of new jobs.
+	InputPolicy InputPolicy
+	// Set if http.DefaultClient has TLS settings ffmpeg doesn't, such as extra trusted CAs or
+	// skipped verification. ffmpeg then never fetches inputs itself.
+	CustomInputTLS bool
+	// How inputs are identified in output names.
+	InputNormalization InputNormalization
+	// Restart jobs interrupted by a previous process in Recover. Journals don't keep credentials,
+	// so jobs whose inputs had them aren't restarted.
+	RecoverJobs bool
+	// Named sets of output options that prefetch entries can refer to.
+	Presets map[string][]string
+	// Hashed into output names. Changing it, such as after fixing a preset or upgrading ffmpeg,
+	// stops outputs made before from being served. See Superseded.
+	Generation string
+	// Also hash the ffmpeg version into output names.
+	KeyByFFmpegVersion bool
+	// Encodings of audio-only outputs, keyed by output format. Nil uses DefaultAudioFormats.
+	// Change Generation after changing these, as they aren't hashed into output names.
+	AudioFormats       map[string]AudioFormat
+	ffmpegVersionOnce  sync.Once
+	ffmpegVersionValue string
+	progressListener   net.Listener
+	progressHandler    progressHandler
+	mu                 sync.Mutex
+	operations         map[string]*operation
+	jobs               map[string]*runningJob
+	sched              scheduler
+	// Requests in waitJob.
+	waiting            int
+	recentJobDurations []time.Duration
+	// When outputs last failed.
+	recentFailures map[string]time.Time
+	// Set by CheckCapabilities.
+	capabilities *Capabilities
+	events       pubsub.PubSub[struct{}]
+	jobWebhooks  map[string][]string
+	webhookLog   []WebhookDelivery
+	metrics      metrics
 }
 
 func (t *Transcoder) Init() {
 	t.operations = make(map[string]*operation)
+	t.jobs = make(map[string]*runningJob)
+	t.sched.max = t.MaxJobs
+	t.recentFailures = make(map[string]time.Time)
+	t.initMetrics()
 	var err error
 	t.progressListener, err = net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -196,8 +360,13 @@ func (t *Transcoder) Init() {
 			return
 		}
 		op.updateProgress(func(p *Progress) {
-			var err error
-			p.ConvertPos, err = parseProgressInfoOutTime(value)
+			pos, err := parseProgressInfoOutTime(value)
+			// Analysis passes come before conversion, and report progress the same way.
+			if p.Analyzing && !p.Converting {
+				p.AnalyzePos = pos
+			} else {
+				p.ConvertPos = pos
+			}
 			if err != nil {
 				log.Levelf(log.Warning, "error parsing out_time_ms for operation %q: %s", id, err)
 			}
@@ -213,45 +382,32 @@ func (t *Transcoder) Init() {
 		op.sendEvent()
 	}
 
+	mux := http.NewServeMux()
+	mux.Handle("/", &t.progressHandler)
+	mux.HandleFunc("/input", t.serveTorrentInput)
 	go func() {
-		panic(http.Serve(t.progressListener, &t.progressHandler))
+		panic(http.Serve(t.progressListener, mux))
 	}()
 }
 
-func (t *Transcoder) serveEvents(
-	w http.ResponseWriter,
-	r *http.Request,
+// Calls write with the output's progress, and again after it changes, at most every
+// progressInterval, until write returns false, ctx is done, or there's no progress to report.
+func (t *Transcoder) watchProgress(
+	ctx context.Context,
 	outputName string,
 	outputLoc resource.Instance,
+	write func(Progress) bool,
 ) {
 	sub := t.events.Subscribe()
 	defer sub.Close()
-	conn, err := websocket.Accept(w, r, nil)
-	if err != nil {
-		// Accept above sets a http error already.
-		log.Printf("error accepting transcoder events websocket: %v", err)
-		return
-	}
-	ctx := conn.CloseRead(r.Context())
-	defer conn.Close(websocket.StatusGoingAway, "deferred close")
+	t.metrics.eventSubscribers.Inc()
+	defer t.metrics.eventSubscribers.Dec()
 	writeProgress := func() bool {
 		pOpt := t.getProgress(outputLoc, outputName)
 		if !pOpt.Ok {
 			return false
 		}
-		p := pOpt.Value
-		err := wsjson.Write(ctx, conn, p)
-		switch err {
-		case io.ErrClosedPipe:
-			return false
-		case nil:
-			return true
-		default:
-			if ctx.Err() == nil {
-				log.Printf("error encoding transcoder event: %v", err)
-			}
-			return false
-		}
+		return write(pOpt.Value)
 	}
 	if !writeProgress() {
 		return
@@ -270,7 +426,7 @@ func (t *Transcoder) serveEvents(
 				return
 			}
 			select {
-			case <-time.After(100 * time.Millisecond):
+			case <-time.After(progressInterval):
 			case <-ctx.Done():
 				return
 			}
@@ -280,6 +436,45 @@ func (t *Transcoder) serveEvents(
 	}
 }
 
+func (t *Transcoder) serveEvents(
+	w http.ResponseWriter,
+	r *http.Request,
+	outputName string,
+	outputLoc resource.Instance,
+) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		// Same-origin requests are always accepted, and we check the others.
+		InsecureSkipVerify: t.originAllowed(r.Header.Get("Origin")),
+		Subprotocols:       []string{ControlSubprotocol},
+	})
+	if err != nil {
+		// Accept above sets a http error already.
+		log.Printf("error accepting transcoder events websocket: %v", err)
+		return
+	}
+	if conn.Subprotocol() == ControlSubprotocol {
+		defer conn.Close(websocket.StatusGoingAway, "deferred close")
+		t.serveControl(r.Context(), conn, outputName, t.requestClient(r))
+		return
+	}
+	ctx := conn.CloseRead(r.Context())
+	defer conn.Close(websocket.StatusGoingAway, "deferred close")
+	t.watchProgress(ctx, outputName, outputLoc, func(p Progress) bool {
+		err := wsjson.Write(ctx, conn, p)
+		switch err {
+		case io.ErrClosedPipe:
+			return false
+		case nil:
+			return true
+		default:
+			if ctx.Err() == nil {
+				log.Printf("error encoding transcoder event: %v", err)
+			}
+			return false
+		}
+	})
+}
+
 func (t *Transcoder) drainEventSub(sub *pubsub.Subscription[struct{}]) {
 	for {
 		select {
@@ -302,44 +497,126 @@ func (t *Transcoder) assertEventValue(value any) {
 	}
 }
 
+// Serves a stored output, returning false if it doesn't exist. Output names are hashes of everything
+// that determines the content, so they make strong validators and the content never changes.
+func serveOutput(w http.ResponseWriter, r *http.Request, j job, outputLoc resource.Instance) bool {
+	outputName := j.outputName
+	fi, err := outputLoc.Stat()
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{
+		"filename": j.filename(),
+	}))
+	w.Header().Set("ETag", strconv.Quote(outputName))
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	http.ServeContent(w, r, outputName, fi.ModTime(), io.NewSectionReader(outputLoc, 0, fi.Size()))
+	return true
+}
+
 func (t *Transcoder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Everything but completed outputs reflects the current state of things.
+	w.Header().Set("Cache-Control", "no-store")
+	if t.handleCORS(w, r) {
+		return
+	}
+	switch r.URL.Path {
+	case "/webhooks":
+		t.serveWebhookLog(w, r)
+		return
+	case "/metrics":
+		t.serveMetrics(w, r)
+		return
+	case "/history":
+		t.serveHistory(w, r)
+		return
+	case "/prefetch":
+		t.servePrefetch(w, r)
+		return
+	case "/healthz":
+		t.serveHealthz(w, r)
+		return
+	case "/readyz":
+		t.serveReadyz(w, r)
+		return
+	case "/capabilities":
+		t.serveCapabilities(w, r)
+		return
+	case "/explain":
+		t.serveExplain(w, r)
+		return
+	case "/jobs":
+		// Without an input, list the running jobs rather than submitting one.
+		if r.Method == http.MethodGet && !r.URL.Query().Has("i") {
+			t.serveJobs(w, r)
+			return
+		}
+	}
 	q := r.URL.Query()
-	i := reencodeURL(q.Get("i"))
-	f := q.Get("f")
-	opts := q["opt"]
-	iopts := q["iopt"]
-	outputName := fmt.Sprintf(
-		"%x.%s",
-		hashStrings(append(iopts, append(opts, i)...)),
-		f,
-	)
+	j := t.newJob(q)
+	j.client = t.requestClient(r)
+	outputName := j.outputName
 	outputLoc, err := t.RP.NewInstance(outputName)
 	if err != nil {
 		log.Print(err)
 		http.Error(w, "bad output location", http.StatusInternalServerError)
 		return
 	}
-	if r.URL.Path == "/events" {
-		t.serveEvents(w, r, outputName, outputLoc)
+	switch r.URL.Path {
+	case "/events":
+		if acceptsEventStream(r) {
+			t.serveEventStream(w, r, outputName, outputLoc)
+		} else {
+			t.serveEvents(w, r, outputName, outputLoc)
+		}
+		return
+	case "/progress":
+		t.serveProgress(w, r, outputName, outputLoc)
+		return
+	case "/log":
+		t.serveLog(w, r, j)
+		return
+	case "/jobs":
+		if t.checkInput(w, j) {
+			t.serveSubmit(w, r, j, outputLoc)
+		}
+		return
+	}
+	if !t.checkInput(w, j) {
 		return
 	}
+	cacheResult := "hit"
 	for {
-		if rs := resource.ReadSeeker(outputLoc); rs != nil {
-			http.ServeContent(w, r, outputName, time.Time{}, rs)
+		if serveOutput(w, r, j, outputLoc) {
+			t.metrics.cacheRequests.WithLabelValues(cacheResult).Inc()
 			return
 		}
-		_, _, err := t.sf.Do(
-			r.Context(),
-			outputName,
-			func(ctx context.Context) (_ struct{}, err error) {
-				err = t.transcode(ctx, outputName, i, opts, iopts)
-				if err != nil {
-					log.Printf("error transcoding %q: %s", outputName, err)
-				}
+		if r.Method == http.MethodHead {
+			// Report whether the output exists without transcoding it.
+			t.mu.Lock()
+			running := t.jobs[outputName] != nil
+			t.mu.Unlock()
+			if running {
+				w.WriteHeader(http.StatusAccepted)
+			} else {
+				w.WriteHeader(http.StatusNotFound)
+			}
+			return
+		}
+		if cacheResult == "hit" {
+			if retryAfter, shed := t.shouldShed(j, true); shed {
+				t.serveShed(w, retryAfter)
 				return
-			},
-		)
+			}
+		}
+		cacheResult = "miss"
+		t.addJobWebhooks(outputName, j.webhooks)
+		err := t.waitJob(r.Context(), t.startJob(j, false), j.client)
+		if errors.Is(err, errUnwatched) {
+			continue
+		}
 		if err != nil {
+			t.metrics.cacheRequests.WithLabelValues(cacheResult).Inc()
 			http.Error(w, "error transcoding", http.StatusInternalServerError)
 			return
 		}
@@ -2,7 +2,12 @@ package transcoder
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/stretchr/testify/require"
@@ -15,11 +20,64 @@ func TestJSONNaN(t *testing.T) {
 	require.Empty(t, b)
 }
 
-func TestHashStrings(t *testing.T) {
+func TestMetricsJobFinished(t *testing.T) {
 	qtc := qt.New(t)
-	partsHash := hashStrings([]string{"h", "el", "lo"})
-	oneHash := hashStrings([]string{"hello"})
-	qtc.Check(partsHash, qt.Not(qt.DeepEquals), oneHash)
-	qtc.Check(partsHash, qt.HasLen, hashStringsSize)
-	qtc.Check(oneHash, qt.HasLen, hashStringsSize)
+	var tc Transcoder
+	tc.Init()
+	started := time.Now()
+	tc.metrics.jobFinished(JobResult{
+		State:         JobCompleted,
+		InputDuration: time.Minute,
+		Stages: map[string]StageTimes{
+			"convert": {started, started.Add(30 * time.Second)},
+		},
+	})
+	w := httptest.NewRecorder()
+	tc.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	qtc.Check(body, qt.Contains, `transcoder_jobs_finished_total{stage="convert",state="completed"} 1`)
+	qtc.Check(body, qt.Contains, `transcoder_convert_realtime_factor_sum 2`)
+	qtc.Check(body, qt.Contains, "transcoder_operations 0")
+}
+
+func TestOutputCaching(t *testing.T) {
+	qtc := qt.New(t)
+	tc := newTestTranscoder(t)
+	j := jobFromQuery(url.Values{"i": {"http://example.com/input.avi"}, "f": {"mp4"}})
+	target := "/?" + url.Values{"i": {j.input}, "f": {j.format}}.Encode()
+	serve := func(method string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		tc.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(http.MethodHead, nil)
+	qtc.Check(w.Code, qt.Equals, http.StatusNotFound)
+	qtc.Check(w.Header().Get("Cache-Control"), qt.Equals, "no-store")
+	qtc.Check(tc.jobs, qt.HasLen, 0)
+
+	loc, err := tc.RP.NewInstance(j.outputName)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Assert(loc.Put(strings.NewReader("output")), qt.IsNil)
+	w = serve(http.MethodGet, nil)
+	qtc.Assert(w.Code, qt.Equals, http.StatusOK)
+	qtc.Check(w.Body.String(), qt.Equals, "output")
+	etag := w.Header().Get("ETag")
+	qtc.Check(etag, qt.Equals, `"`+j.outputName+`"`)
+	qtc.Check(w.Header().Get("Cache-Control"), qt.Equals, "public, max-age=31536000, immutable")
+	lastModified := w.Header().Get("Last-Modified")
+	qtc.Check(lastModified, qt.Not(qt.Equals), "")
+
+	w = serve(http.MethodGet, http.Header{"If-None-Match": {etag}})
+	qtc.Check(w.Code, qt.Equals, http.StatusNotModified)
+	w = serve(http.MethodGet, http.Header{"If-Modified-Since": {lastModified}})
+	qtc.Check(w.Code, qt.Equals, http.StatusNotModified)
+	w = serve(http.MethodHead, nil)
+	qtc.Check(w.Code, qt.Equals, http.StatusOK)
+	qtc.Check(w.Header().Get("Content-Length"), qt.Equals, "6")
+	qtc.Check(w.Body.Len(), qt.Equals, 0)
 }
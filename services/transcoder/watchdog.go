@@ -0,0 +1,69 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+// The cause of jobs killed by the watchdog.
+var ErrTimeout = errors.New("timed out")
+
+var watchdogInterval = time.Second
+
+// Returns an error if the operation has stalled or overrun a stage.
+func (t *Transcoder) checkOperation(op *operation, now time.Time) error {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	if op.Progress.Queued {
+		return nil
+	}
+	if t.StallTimeout != 0 && now.Sub(op.lastActivity) > t.StallTimeout {
+		return fmt.Errorf("%w: no progress for %v", ErrTimeout, t.StallTimeout)
+	}
+	for stage, limit := range t.StageTimeouts {
+		st, ok := op.stages[stage]
+		if !ok || st.Started.IsZero() || !st.Finished.IsZero() || limit == 0 {
+			continue
+		}
+		since := st.Started
+		if stage == "download" && op.torrentFile != nil {
+			// Torrent inputs download while they're converted, so only a lack of progress counts.
+			if op.lastDownload.After(since) {
+				since = op.lastDownload
+			}
+			if now.Sub(since) > limit {
+				return fmt.Errorf("%w: no download progress for %v", ErrTimeout, limit)
+			}
+			continue
+		}
+		if now.Sub(since) > limit {
+			return fmt.Errorf("%w: %s stage exceeded %v", ErrTimeout, stage, limit)
+		}
+	}
+	return nil
+}
+
+// Cancels the job with the reason when the operation stalls or overruns a stage.
+func (t *Transcoder) watchOperation(ctx context.Context, outputName string, op *operation, cancel context.CancelCauseFunc) {
+	if t.StallTimeout == 0 && len(t.StageTimeouts) == 0 {
+		return
+	}
+	ticker := time.NewTicker(watchdogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := t.checkOperation(op, now); err != nil {
+				log.Printf("killing %q: %v", outputName, err)
+				cancel(err)
+				return
+			}
+		}
+	}
+}
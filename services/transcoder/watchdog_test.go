@@ -0,0 +1,84 @@
+package transcoder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCheckOperation(t *testing.T) {
+	qtc := qt.New(t)
+	tc := Transcoder{
+		StallTimeout:  time.Minute,
+		StageTimeouts: map[string]time.Duration{"convert": time.Hour},
+	}
+	op := newOperation(func() {})
+	now := op.lastActivity
+	qtc.Check(tc.checkOperation(op, now.Add(time.Second)), qt.IsNil)
+	qtc.Check(tc.checkOperation(op, now.Add(2*time.Minute)), qt.ErrorMatches, "timed out: no progress for 1m0s")
+	op.updateProgress(func(p *Progress) {
+		p.Converting = true
+	})
+	op.mu.Lock()
+	op.lastActivity = now.Add(2 * time.Hour)
+	op.mu.Unlock()
+	err := tc.checkOperation(op, now.Add(2*time.Hour))
+	qtc.Check(errors.Is(err, ErrTimeout), qt.IsTrue)
+	qtc.Check(err, qt.ErrorMatches, "timed out: convert stage exceeded 1h0m0s")
+}
+
+// Torrent inputs are downloaded as they're converted, so only a lack of download progress times
+// out the download stage.
+func TestTorrentDownloadTimeout(t *testing.T) {
+	qtc := qt.New(t)
+	tc := Transcoder{
+		StageTimeouts: map[string]time.Duration{"download": time.Minute},
+	}
+	op := newOperation(func() {})
+	op.torrentFile = &torrent.File{}
+	op.updateProgress(func(p *Progress) {
+		p.Downloading = true
+	})
+	start := op.lastActivity
+	for i := 1; i <= 5; i++ {
+		op.updateProgress(func(p *Progress) {
+			p.DownloadProgress = float64(i) / 10
+		})
+		op.mu.Lock()
+		op.lastDownload = start.Add(time.Duration(i) * 50 * time.Second)
+		op.mu.Unlock()
+	}
+	qtc.Check(tc.checkOperation(op, start.Add(5*time.Minute)), qt.IsNil)
+	qtc.Check(tc.checkOperation(op, start.Add(6*time.Minute)), qt.ErrorMatches, "timed out: no download progress for 1m0s")
+	op.torrentFile = nil
+	qtc.Check(tc.checkOperation(op, start.Add(5*time.Minute)), qt.ErrorMatches, "timed out: download stage exceeded 1m0s")
+}
+
+func TestStalledDownloadIsKilled(t *testing.T) {
+	qtc := qt.New(t)
+	oldInterval := watchdogInterval
+	watchdogInterval = time.Millisecond
+	t.Cleanup(func() { watchdogInterval = oldInterval })
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	tc := Transcoder{
+		OutputDir:    t.TempDir(),
+		StallTimeout: 50 * time.Millisecond,
+	}
+	tc.Init()
+	j := jobFromQuery(url.Values{"i": {srv.URL + "/input.rmvb"}, "f": {"mp4"}})
+	err := tc.transcode(context.Background(), j, tc.newOperation())
+	qtc.Check(errors.Is(err, ErrTimeout), qt.IsTrue, qt.Commentf("%v", err))
+}
@@ -0,0 +1,157 @@
+package transcoder
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/anacrolix/log"
+)
+
+const (
+	webhookAttempts = 5
+	// Entries kept in the webhook delivery log.
+	webhookLogSize = 100
+	// Signature of the payload, when a secret is configured.
+	WebhookSignatureHeader = "X-Transcoder-Signature"
+)
+
+// Doubles after each failed attempt.
+var webhookRetryDelay = time.Second
+
+// A webhook delivery, successful or otherwise, as it appears in the delivery log.
+type WebhookDelivery struct {
+	URL        string
+	OutputName string
+	State      JobState
+	Attempts   int
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	Time       time.Time
+}
+
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Registers webhooks given in a request for a job that may not have started yet.
+func (t *Transcoder) addJobWebhooks(outputName string, urls []string) {
+	if len(urls) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.jobWebhooks == nil {
+		t.jobWebhooks = make(map[string][]string)
+	}
+	existing := t.jobWebhooks[outputName]
+next:
+	for _, u := range urls {
+		for _, e := range existing {
+			if e == u {
+				continue next
+			}
+		}
+		existing = append(existing, u)
+	}
+	t.jobWebhooks[outputName] = existing
+}
+
+// Sends the result to the configured webhooks and those the job's requests gave. Credentials in
+// the input are redacted.
+func (t *Transcoder) notifyWebhooks(res JobResult) {
+	t.mu.Lock()
+	urls := append(t.Webhooks[:len(t.Webhooks):len(t.Webhooks)], t.jobWebhooks[res.OutputName]...)
+	delete(t.jobWebhooks, res.OutputName)
+	t.mu.Unlock()
+	if len(urls) == 0 {
+		return
+	}
+	res = res.redacted()
+	body, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("error marshalling webhook payload for %q: %v", res.OutputName, err)
+		return
+	}
+	for _, u := range urls {
+		go t.deliverWebhook(context.Background(), u, res, body)
+	}
+}
+
+func (t *Transcoder) deliverWebhook(ctx context.Context, url string, res JobResult, body []byte) {
+	d := WebhookDelivery{
+		URL:        url,
+		OutputName: res.OutputName,
+		State:      res.State,
+	}
+	delay := webhookRetryDelay
+	for {
+		d.Attempts++
+		d.StatusCode, d.Error = 0, ""
+		err := t.postWebhook(ctx, url, body, &d.StatusCode)
+		if err == nil {
+			break
+		}
+		d.Error = err.Error()
+		if d.Attempts >= webhookAttempts {
+			log.Printf("giving up delivering webhook for %q to %q: %v", res.OutputName, url, err)
+			break
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			d.Error = ctx.Err().Error()
+			t.logWebhookDelivery(d)
+			return
+		}
+		delay *= 2
+	}
+	t.logWebhookDelivery(d)
+}
+
+func (t *Transcoder) postWebhook(ctx context.Context, url string, body []byte, statusCode *int) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if t.WebhookSecret != "" {
+		req.Header.Set(WebhookSignatureHeader, signWebhookPayload(t.WebhookSecret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	*statusCode = resp.StatusCode
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *Transcoder) logWebhookDelivery(d WebhookDelivery) {
+	d.Time = time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.webhookLog = append(t.webhookLog, d)
+	if len(t.webhookLog) > webhookLogSize {
+		t.webhookLog = t.webhookLog[len(t.webhookLog)-webhookLogSize:]
+	}
+}
+
+func (t *Transcoder) serveWebhookLog(w http.ResponseWriter, r *http.Request) {
+	t.mu.Lock()
+	deliveries := append([]WebhookDelivery(nil), t.webhookLog...)
+	t.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
@@ -0,0 +1,119 @@
+// Package torrents finds files in torrents given by magnet URI or infohash.
+package torrents
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/metainfo"
+
+	wtpub "github.com/anacrolix/webtorrent-public"
+)
+
+var ErrFileNotFound = errors.New("file not found in torrent")
+
+// Returns whether s looks like something Add accepts: a magnet URI or a hex infohash.
+func IsRef(s string) bool {
+	if strings.HasPrefix(s, "magnet:") {
+		return true
+	}
+	var ih metainfo.Hash
+	return len(s) == 2*len(ih) && ih.FromHexString(s) == nil
+}
+
+var (
+	mu sync.Mutex
+	// Readers of torrents that Add put in their clients.
+	readers = make(map[*torrent.Torrent]int)
+)
+
+// Adds the torrent referred to by a magnet URI or hex infohash to the client, and waits for its
+// info. release must be called when the caller is done reading the torrent. Torrents that Add put
+// in the client are dropped when their last reader releases them, while those that were there
+// already are left alone.
+func Add(ctx context.Context, cl *torrent.Client, ref string) (t *torrent.Torrent, release func(), err error) {
+	var spec *torrent.TorrentSpec
+	var ih metainfo.Hash
+	if strings.HasPrefix(ref, "magnet:") {
+		spec, err = torrent.TorrentSpecFromMagnetUri(ref)
+	} else if err = ih.FromHexString(ref); err != nil {
+		err = fmt.Errorf("parsing infohash: %w", err)
+	}
+	if err != nil {
+		return
+	}
+	mu.Lock()
+	var isNew bool
+	if spec != nil {
+		t, isNew, err = cl.AddTorrentSpec(spec)
+		if err != nil {
+			mu.Unlock()
+			return
+		}
+	} else {
+		t, isNew = cl.AddTorrentInfoHash(ih)
+	}
+	release = func() {}
+	if _, ok := readers[t]; ok || isNew {
+		readers[t]++
+		var once sync.Once
+		release = func() {
+			once.Do(func() { drop(t) })
+		}
+	}
+	mu.Unlock()
+	select {
+	case <-t.GotInfo():
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+	return
+}
+
+func drop(t *torrent.Torrent) {
+	mu.Lock()
+	defer mu.Unlock()
+	readers[t]--
+	if readers[t] == 0 {
+		delete(readers, t)
+		t.Drop()
+	}
+}
+
+// Returns the files of a torrent, excluding padding files.
+func Files(t *torrent.Torrent) (ret []*torrent.File) {
+	for _, f := range t.Files() {
+		fi := f.FileInfo()
+		if wtpub.IsPaddingPath(fi.BestPath()) {
+			continue
+		}
+		ret = append(ret, f)
+	}
+	return
+}
+
+// Finds the file with the given display path. An empty path selects the torrent's only file, or
+// the largest if there are several. Padding files are never returned.
+func File(t *torrent.Torrent, path string) (*torrent.File, error) {
+	var largest *torrent.File
+	for _, f := range Files(t) {
+		if path == "" {
+			if largest == nil || f.Length() > largest.Length() {
+				largest = f
+			}
+			continue
+		}
+		if f.DisplayPath() == path {
+			return f, nil
+		}
+	}
+	if largest == nil {
+		return nil, fmt.Errorf("%w: %q", ErrFileNotFound, path)
+	}
+	return largest, nil
+}
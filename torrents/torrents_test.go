@@ -0,0 +1,73 @@
+package torrents
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestFileSkipsPadding(t *testing.T) {
+	qtc := qt.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	qtc.Assert(err, qt.IsNil)
+	defer cl.Close()
+	info := metainfo.Info{
+		Name:        "season",
+		PieceLength: 1 << 14,
+		Files: []metainfo.FileInfo{
+			{Path: []string{"episode.mkv"}, Length: 100},
+			{Path: []string{".pad", "16284"}, Length: 16284},
+			{Path: []string{"episode.srt"}, Length: 10},
+		},
+	}
+	info.Pieces = make([]byte, 20*2)
+	var mi metainfo.MetaInfo
+	mi.InfoBytes, err = bencode.Marshal(info)
+	qtc.Assert(err, qt.IsNil)
+	tor, err := cl.AddTorrent(&mi)
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(Files(tor), qt.HasLen, 2)
+	f, err := File(tor, "")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(f.DisplayPath(), qt.Equals, "episode.mkv")
+	f, err = File(tor, "episode.srt")
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(f.Length(), qt.Equals, int64(10))
+	_, err = File(tor, ".pad/16284")
+	qtc.Check(errors.Is(err, ErrFileNotFound), qt.IsTrue)
+	// Already added, so the info is available immediately.
+	added, release, err := Add(context.Background(), cl, tor.InfoHash().HexString())
+	qtc.Assert(err, qt.IsNil)
+	qtc.Check(added, qt.Equals, tor)
+	// It wasn't added by Add, so it stays.
+	release()
+	_, ok := cl.Torrent(tor.InfoHash())
+	qtc.Check(ok, qt.IsTrue)
+}
+
+func TestAddDropsUnreadTorrents(t *testing.T) {
+	qtc := qt.New(t)
+	cl, err := torrent.NewClient(torrent.TestingConfig(t))
+	qtc.Assert(err, qt.IsNil)
+	defer cl.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ref := "30764610642571b3c01af11d6ce60cfa164d7ee3"
+	_, _, err = Add(ctx, cl, ref)
+	qtc.Check(err, qt.Equals, context.Canceled)
+	qtc.Check(cl.Torrents(), qt.HasLen, 0)
+	qtc.Check(readers, qt.HasLen, 0)
+}
+
+func TestIsRef(t *testing.T) {
+	qtc := qt.New(t)
+	qtc.Check(IsRef("30764610642571b3c01af11d6ce60cfa164d7ee3"), qt.IsTrue)
+	qtc.Check(IsRef("magnet:?xt=urn:btih:30764610642571b3c01af11d6ce60cfa164d7ee3"), qt.IsTrue)
+	qtc.Check(IsRef("http://webtorrent.anacrolix.link/30764610642571b3c01af11d6ce60cfa164d7ee3/file"), qt.IsFalse)
+	qtc.Check(IsRef("3076461064"), qt.IsFalse)
+}